@@ -6,12 +6,18 @@ require (
 	github.com/evanj/hacks v0.0.0-20230519195856-34ba7f4a6c00
 	github.com/evanj/pgxtypefaster v0.0.0-20230707142147-d003a6845508
 	github.com/jackc/pgx/v5 v5.4.2-0.20230629222547-dc94db6b3d40
+	github.com/linkedin/goavro/v2 v2.12.0
+	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	github.com/golang/snappy v0.0.1 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.0 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
 )
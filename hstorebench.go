@@ -45,9 +45,10 @@ func queryHstoreOIDSQL(ctx context.Context, db *sql.DB) (uint32, error) {
 	return hstoreOID, nil
 }
 
-// registerHstoreTypeMap registers the hstore type with typeMap. It uses conn to query for
-func registerHstoreTypeMap(hstoreOID uint32, typeMap *pgtype.Map) {
-	typeMap.RegisterType(&pgtype.Type{Codec: pgtype.HstoreCodec{}, Name: "hstore", OID: hstoreOID})
+// registerHstoreTypeMap registers the hstore type with typeMap, using codec to encode and decode
+// it. Registering the same OID again replaces the codec.
+func registerHstoreTypeMap(hstoreOID uint32, typeMap *pgtype.Map, codec pgtype.Codec) {
+	typeMap.RegisterType(&pgtype.Type{Codec: codec, Name: "hstore", OID: hstoreOID})
 }
 
 // registerHstore registers the hstore type with this connection's default type map. A connection
@@ -57,7 +58,7 @@ func registerHstore(ctx context.Context, conn *pgx.Conn) error {
 	if err != nil {
 		return err
 	}
-	registerHstoreTypeMap(hstoreOID, conn.TypeMap())
+	registerHstoreTypeMap(hstoreOID, conn.TypeMap(), pgtype.HstoreCodec{})
 	return nil
 }
 
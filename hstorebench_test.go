@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	mathrand "math/rand"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/evanj/hacks/postgrestest"
 	"github.com/evanj/pgxtypefaster"
@@ -18,12 +23,36 @@ const numRows = 10000
 const maxKVPairsPerRow = 10
 const rngSeed = 123 // to try to make tests repeatable
 
+// postgresSkipEnvVar disables tests that need Postgres if it is set to any value.
+const postgresSkipEnvVar = "POSTGRES_SKIP"
+
+var shortCircuit = flag.Bool("short-circuit", false,
+	"skip tests and benchmarks that need Postgres; also set by the "+postgresSkipEnvVar+" environment variable")
+
+// skipPostgres is true if tests that need Postgres must be skipped. It is set by TestMain.
+var skipPostgres bool
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	skipPostgres = *shortCircuit || os.Getenv(postgresSkipEnvVar) != ""
+	os.Exit(m.Run())
+}
+
+// skipWithoutPostgres skips the test if tests that need Postgres are disabled.
+func skipWithoutPostgres(tb testing.TB) {
+	tb.Helper()
+	if skipPostgres {
+		tb.Skipf("skipping test that needs Postgres: -short-circuit or %s is set", postgresSkipEnvVar)
+	}
+}
+
 func genString(rng *mathrand.Rand) string {
 	s := fmt.Sprintf("%016x", rng.Int63())
 	return s[0 : 1+rng.Intn(len(s)-1)]
 }
 
 func TestRegisterHstore(t *testing.T) {
+	skipWithoutPostgres(t)
 	postgresURL := postgrestest.New(t)
 	ctx := context.Background()
 	pgxConn, err := pgx.Connect(ctx, postgresURL)
@@ -62,6 +91,127 @@ func TestRegisterHstore(t *testing.T) {
 	}
 }
 
+func TestRegisterHstoreTypeMapTwice(t *testing.T) {
+	// an arbitrary OID: the hstore OID depends on the database
+	const hstoreOID = 100000
+	typeMap := pgtype.NewMap()
+
+	scanAndCheck := func() {
+		t.Helper()
+		var h pgxtypefaster.Hstore
+		err := typeMap.Scan(hstoreOID, pgtype.BinaryFormatCode, keyValueBinary, &h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := pgxtypefaster.Hstore{"key": pgxtypefaster.NewText("value")}
+		if !reflect.DeepEqual(h, expected) {
+			t.Errorf("scanned %#v; expected %#v", h, expected)
+		}
+	}
+
+	registerHstoreTypeMap(hstoreOID, typeMap, pgtype.HstoreCodec{})
+	scanAndCheck()
+	registerHstoreTypeMap(hstoreOID, typeMap, pgxtypefaster.HstoreCodec{})
+	scanAndCheck()
+
+	// the last registered codec wins
+	pgt, ok := typeMap.TypeForOID(hstoreOID)
+	if !ok {
+		t.Fatal("hstore must be registered")
+	}
+	if _, ok := pgt.Codec.(pgxtypefaster.HstoreCodec); !ok {
+		t.Errorf("expected the last registered codec pgxtypefaster.HstoreCodec; got %T", pgt.Codec)
+	}
+	pgt, ok = typeMap.TypeForName("hstore")
+	if !(ok && pgt.OID == hstoreOID) {
+		t.Errorf("TypeForName(hstore)=%#v, %t; expected OID=%d", pgt, ok, hstoreOID)
+	}
+}
+
+// BenchmarkTypeMapOIDLookup measures looking up a type in a pgtype.Map by OID, which pgx does to
+// plan each scan, compared to planning the scan, which includes the lookup.
+func BenchmarkTypeMapOIDLookup(b *testing.B) {
+	// an arbitrary OID: the hstore OID depends on the database
+	const hstoreOID = 100000
+	typeMap := pgtype.NewMap()
+	registerHstoreTypeMap(hstoreOID, typeMap, pgtype.HstoreCodec{})
+
+	oids := []struct {
+		label string
+		oid   uint32
+	}{
+		{"hstore", hstoreOID},
+		{"builtin_text", pgtype.TextOID},
+		{"unregistered", hstoreOID + 1},
+	}
+	for _, oid := range oids {
+		_, expectedOK := typeMap.TypeForOID(oid.oid)
+		b.Run("TypeForOID/"+oid.label, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, ok := typeMap.TypeForOID(oid.oid)
+				if ok != expectedOK {
+					b.Fatalf("TypeForOID(%d) ok=%t; expected %t", oid.oid, ok, expectedOK)
+				}
+			}
+		})
+	}
+
+	b.Run("PlanScan/hstore", func(b *testing.B) {
+		var h pgtype.Hstore
+		for i := 0; i < b.N; i++ {
+			plan := typeMap.PlanScan(hstoreOID, pgtype.BinaryFormatCode, &h)
+			if plan == nil {
+				b.Fatal("PlanScan must return a plan")
+			}
+		}
+	})
+}
+
+// createBenchmarkTable creates the benchmark table and fills it with numRows rows, each with a
+// random hstore with up to maxKVPairsPerRow pairs. The rows have ids from 1 to numRows. It returns
+// the total number of key/value bytes.
+func createBenchmarkTable(tb testing.TB, conn *pgx.Conn) int {
+	ctx := context.Background()
+	_, err := conn.Exec(ctx, "CREATE TABLE benchmark (id SERIAL PRIMARY KEY, kv HSTORE)")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	totalKVBytes := 0
+
+	// generate each row
+	rowBuilder := &strings.Builder{}
+	for i := 0; i < numRows; i++ {
+		rowBuilder.Reset()
+		rowBuilder.WriteByte('\'')
+
+		// generate kv pairs
+		numPairs := 1 + rng.Intn(maxKVPairsPerRow-1)
+		for j := 0; j < numPairs; j++ {
+			keyString := genString(rng)
+			valueString := genString(rng)
+
+			if j != 0 {
+				rowBuilder.WriteByte(',')
+			}
+			rowBuilder.WriteString(keyString)
+			rowBuilder.WriteString("=>")
+			rowBuilder.WriteString(valueString)
+
+			totalKVBytes += len(keyString) + len(valueString)
+		}
+
+		rowBuilder.WriteByte('\'')
+
+		_, err = conn.Exec(ctx, "INSERT INTO benchmark (kv) VALUES ($1);", rowBuilder.String())
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return totalKVBytes
+}
+
 // HstoreSQLBinary uses the binary protocol with the database/sql API.
 // This is a proof-of-concept hack more than a good idea.
 type HstoreSQLBinary struct {
@@ -73,10 +223,24 @@ var pgxfasterBinaryScanPlan = pgxtypefaster.HstoreCodec{}.PlanScan(
 
 // Scan implements the database/sql Scanner interface.
 func (h *HstoreSQLBinary) Scan(src any) error {
+	if src == nil {
+		return pgxfasterBinaryScanPlan.Scan(nil, &h.Hstore)
+	}
 	return pgxfasterBinaryScanPlan.Scan([]byte(src.(string)), &h.Hstore)
 }
 
+// allQueryExecModes are all the pgx query modes. Some use the binary protocol and some use the
+// text protocol.
+var allQueryExecModes = []pgx.QueryExecMode{
+	pgx.QueryExecModeCacheStatement,
+	pgx.QueryExecModeCacheDescribe,
+	pgx.QueryExecModeDescribeExec,
+	pgx.QueryExecModeExec,
+	pgx.QueryExecModeSimpleProtocol,
+}
+
 func BenchmarkHstore(b *testing.B) {
+	skipWithoutPostgres(b)
 	b.Log("starting postgres instance")
 
 	instance, err := postgrestest.NewInstanceWithOptions(postgrestest.Options{ListenOnLocalhost: true})
@@ -133,43 +297,7 @@ func BenchmarkHstore(b *testing.B) {
 	}
 	b.Cleanup(func() { pgxConnFasterHstoreRegistered.Close(context.Background()) })
 
-	_, err = pgxConn.Exec(ctx, "CREATE TABLE benchmark (kv HSTORE)")
-	if err != nil {
-		panic(err)
-	}
-
-	rng := mathrand.New(mathrand.NewSource(rngSeed))
-	totalKVBytes := 0
-
-	// generate each row
-	rowBuilder := &strings.Builder{}
-	for i := 0; i < numRows; i++ {
-		rowBuilder.Reset()
-		rowBuilder.WriteByte('\'')
-
-		// generate kv pairs
-		numPairs := 1 + rng.Intn(maxKVPairsPerRow-1)
-		for j := 0; j < numPairs; j++ {
-			keyString := genString(rng)
-			valueString := genString(rng)
-
-			if j != 0 {
-				rowBuilder.WriteByte(',')
-			}
-			rowBuilder.WriteString(keyString)
-			rowBuilder.WriteString("=>")
-			rowBuilder.WriteString(valueString)
-
-			totalKVBytes += len(keyString) + len(valueString)
-		}
-
-		rowBuilder.WriteByte('\'')
-
-		_, err = pgxConn.Exec(ctx, "INSERT INTO benchmark VALUES ($1);", rowBuilder.String())
-		if err != nil {
-			panic(err)
-		}
-	}
+	totalKVBytes := createBenchmarkTable(b, pgxConn)
 	b.Logf("   generated %d total KV bytes\n", totalKVBytes)
 
 	hstoreOID, err := queryHstoreOIDSQL(ctx, sqlDB)
@@ -192,6 +320,23 @@ func BenchmarkHstore(b *testing.B) {
 		return rows.Err()
 	}
 
+	// decodes the text format with the TextDecoder interface
+	pgxRawValuesTextDecoder := func() error {
+		rows, err := pgxConn.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		var h TextDecodableHstore
+		var decoder TextDecoder = &h
+		for rows.Next() {
+			err = decoder.DecodeText(rows.RawValues()[0])
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
 	// calls rows.Values() which returns a type string
 	pgxValuesString := func() error {
 		rows, err := pgxConn.Query(ctx, query)
@@ -298,6 +443,7 @@ func BenchmarkHstore(b *testing.B) {
 	}
 
 	b.Run("pgxRawValues", timeIt(pgxRawValues))
+	b.Run("pgxRawValuesTextDecoder", timeIt(pgxRawValuesTextDecoder))
 	b.Run("pgxValuesString", timeIt(pgxValuesString))
 	b.Run("pgxValuesHstoreRegistered", timeIt(pgxValuesHstoreRegistered))
 	b.Run("pgxsqlScanHstore", timeIt(sqlScanHstore))
@@ -305,14 +451,6 @@ func BenchmarkHstore(b *testing.B) {
 	b.Run("pgxsqlScanHstoreBinaryRawConn", timeIt(sqlScanHstoreFasterRawBinary))
 
 	// test pgx.Scan with the registered codec with all query modes
-	// some use the binary protocol and some use the text protocol
-	queryModes := []pgx.QueryExecMode{
-		pgx.QueryExecModeCacheStatement,
-		pgx.QueryExecModeCacheDescribe,
-		pgx.QueryExecModeDescribeExec,
-		pgx.QueryExecModeExec,
-		pgx.QueryExecModeSimpleProtocol,
-	}
 	connConfigs := []struct {
 		label      string
 		conn       *pgx.Conn
@@ -339,7 +477,7 @@ func BenchmarkHstore(b *testing.B) {
 		},
 	}
 	for _, connConfig := range connConfigs {
-		for _, queryMode := range queryModes {
+		for _, queryMode := range allQueryExecModes {
 			scanArgs := []interface{}{connConfig.newScanArg()}
 
 			label := fmt.Sprintf("pgxScan/%s/mode=%s", connConfig.label, queryMode)
@@ -373,3 +511,1483 @@ func timeIt(f func() error) func(b *testing.B) {
 		}
 	}
 }
+
+// newHstoreConfig starts a temporary Postgres instance and creates the hstore extension. It returns
+// the config to connect to it. The instance is shut down when the test completes.
+func newHstoreConfig(tb testing.TB) *pgx.ConnConfig {
+	skipWithoutPostgres(tb)
+	postgresURL := postgrestest.New(tb)
+	cfg, err := pgx.ParseConfig(postgresURL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conn := connect(tb, cfg)
+	_, err = conn.Exec(context.Background(), "CREATE EXTENSION hstore")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cfg
+}
+
+// connect returns a new connection using cfg. The connection is closed when the test completes.
+func connect(tb testing.TB, cfg *pgx.ConnConfig) *pgx.Conn {
+	conn, err := pgx.ConnectConfig(context.Background(), cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close(context.Background()) })
+	return conn
+}
+
+// connectRegistered returns a new connection with hstore registered by registerHstore, so it uses
+// the binary format. The connection is closed when the test completes.
+func connectRegistered(tb testing.TB, cfg *pgx.ConnConfig) *pgx.Conn {
+	conn := connect(tb, cfg)
+	err := registerHstore(context.Background(), conn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return conn
+}
+
+// querier is implemented by pgx.Conn, pgx.Tx, and pgxpool.Pool.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// scanHstores runs query and scans each row into an hstore. It returns the number of rows.
+func scanHstores(ctx context.Context, q querier, query string, args ...any) (int, error) {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	numRows := 0
+	var h pgtype.Hstore
+	for rows.Next() {
+		err := rows.Scan(&h)
+		if err != nil {
+			return 0, err
+		}
+		numRows++
+	}
+	return numRows, rows.Err()
+}
+
+// genHstore returns an hstore with exactly numPairs random key/value pairs.
+func genHstore(rng *mathrand.Rand, numPairs int) pgtype.Hstore {
+	h := make(pgtype.Hstore, numPairs)
+	for len(h) < numPairs {
+		value := genString(rng)
+		h[genString(rng)] = &value
+	}
+	return h
+}
+
+func BenchmarkHstoreQueryParam(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	for _, size := range []int{1, 10, 50, 100} {
+		h := genHstore(rng, size)
+
+		// the query returns a single int so the result is cheap to discard: the cost is the encoding
+		// of the parameter and the query execution
+		b.Run(fmt.Sprintf("size%d", size), timeIt(func() error {
+			var numKeys int
+			err := conn.QueryRow(ctx, "SELECT array_length(akeys($1::hstore), 1)", h).Scan(&numKeys)
+			if err != nil {
+				return err
+			}
+			if numKeys != len(h) {
+				return fmt.Errorf("expected %d keys; got %d", len(h), numKeys)
+			}
+			return nil
+		}))
+	}
+}
+
+func BenchmarkHstoreFieldDescriptions(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	hstoreOID, err := queryHstoreOID(ctx, conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const query = "SELECT kv FROM benchmark"
+	var h pgtype.Hstore
+	scanArgs := []any{&h}
+
+	// calls rows.FieldDescriptions() for every row, like an ORM that checks the column types
+	b.Run("per_row", timeIt(func() error {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			fields := rows.FieldDescriptions()
+			if fields[0].DataTypeOID != hstoreOID {
+				return fmt.Errorf("unexpected column type OID=%d", fields[0].DataTypeOID)
+			}
+			err := rows.Scan(scanArgs...)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}))
+
+	// calls rows.FieldDescriptions() once per query
+	b.Run("prefetched", timeIt(func() error {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		fields := rows.FieldDescriptions()
+		for rows.Next() {
+			if fields[0].DataTypeOID != hstoreOID {
+				return fmt.Errorf("unexpected column type OID=%d", fields[0].DataTypeOID)
+			}
+			err := rows.Scan(scanArgs...)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}))
+}
+
+// bufferReuseRows wraps pgx.Rows to decode a single hstore column from a copy of the raw value. If
+// reuseBuffer is true, it copies every row into the same buffer. This is safe because the decode
+// completes before the next row is fetched. Otherwise, it allocates a new buffer for each row.
+type bufferReuseRows struct {
+	pgx.Rows
+	plan        pgtype.ScanPlan
+	reuseBuffer bool
+	buf         []byte
+}
+
+func (r *bufferReuseRows) Scan(dest ...any) error {
+	if len(dest) != 1 {
+		return fmt.Errorf("bufferReuseRows: expected 1 scan destination; got %d", len(dest))
+	}
+	raw := r.RawValues()[0]
+	if raw == nil {
+		return r.plan.Scan(nil, dest[0])
+	}
+	if !r.reuseBuffer {
+		r.buf = nil
+	}
+	r.buf = append(r.buf[:0], raw...)
+	return r.plan.Scan(r.buf, dest[0])
+}
+
+// BenchmarkHstoreByteBufferReuse compares the allocations of copying each raw value into a new or a
+// reused buffer before decoding it. rows_scan is the baseline: pgx passes the raw row bytes to the
+// scan plan without copying them.
+func BenchmarkHstoreByteBufferReuse(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	hstoreOID, err := queryHstoreOID(ctx, conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var h pgtype.Hstore
+	plan := pgtype.HstoreCodec{}.PlanScan(conn.TypeMap(), hstoreOID, pgtype.BinaryFormatCode, &h)
+
+	const query = "SELECT kv FROM benchmark"
+	scanAll := func(rows pgx.Rows) error {
+		for rows.Next() {
+			err := rows.Scan(&h)
+			if err != nil {
+				return err
+			}
+			if len(h) == 0 {
+				return fmt.Errorf("unexpected empty hstore: %#v", h)
+			}
+		}
+		return rows.Err()
+	}
+
+	b.Run("rows_scan", func(b *testing.B) {
+		b.ReportAllocs()
+		timeIt(func() error {
+			rows, err := conn.Query(ctx, query)
+			if err != nil {
+				return err
+			}
+			return scanAll(rows)
+		})(b)
+	})
+	for _, reuseBuffer := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuseBuffer=%t", reuseBuffer), func(b *testing.B) {
+			b.ReportAllocs()
+			timeIt(func() error {
+				rows, err := conn.Query(ctx, query)
+				if err != nil {
+					return err
+				}
+				return scanAll(&bufferReuseRows{rows, plan, reuseBuffer, nil})
+			})(b)
+		})
+	}
+}
+
+func BenchmarkHstoreRecursiveCTE(b *testing.B) {
+	const maxDepth = 5
+	const childrenPerNode = 4
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, `CREATE TABLE nodes (
+		id INTEGER PRIMARY KEY,
+		parent_id INTEGER REFERENCES nodes (id),
+		props HSTORE)`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// create a tree with maxDepth levels below the root, with edge properties in each node
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	numNodes := 0
+	insertNode := func(parentID any) (int, error) {
+		id := numNodes
+		numNodes++
+		props := genHstore(rng, 1+rng.Intn(maxKVPairsPerRow-1))
+		_, err := conn.Exec(ctx, "INSERT INTO nodes VALUES ($1, $2, $3)", id, parentID, props)
+		return id, err
+	}
+	rootID, err := insertNode(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	level := []int{rootID}
+	for depth := 1; depth <= maxDepth; depth++ {
+		var nextLevel []int
+		for _, parentID := range level {
+			for i := 0; i < childrenPerNode; i++ {
+				id, err := insertNode(parentID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				nextLevel = append(nextLevel, id)
+			}
+		}
+		level = nextLevel
+	}
+	b.Logf("created tree with %d nodes", numNodes)
+
+	const query = `WITH RECURSIVE tree (id, props, depth) AS (
+		SELECT id, props, 0 FROM nodes WHERE parent_id IS NULL
+		UNION ALL
+		SELECT n.id, n.props, t.depth + 1 FROM nodes n JOIN tree t ON n.parent_id = t.id
+			WHERE t.depth < $1
+	) SELECT props, depth FROM tree`
+
+	b.Run("traverse", func(b *testing.B) {
+		var props pgtype.Hstore
+		var depth int
+		for i := 0; i < b.N; i++ {
+			rows, err := conn.Query(ctx, query, maxDepth)
+			if err != nil {
+				b.Fatal(err)
+			}
+			nodesProcessed := 0
+			for rows.Next() {
+				err = rows.Scan(&props, &depth)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(props) == 0 {
+					b.Fatalf("unexpected empty hstore: %#v", props)
+				}
+				nodesProcessed++
+			}
+			if rows.Err() != nil {
+				b.Fatal(rows.Err())
+			}
+			if nodesProcessed != numNodes {
+				b.Fatalf("expected %d nodes; processed %d", numNodes, nodesProcessed)
+			}
+		}
+		b.ReportMetric(float64(numNodes*b.N)/b.Elapsed().Seconds(), "nodes/s")
+	})
+}
+
+func BenchmarkHstoreSortedByKeyCount(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// copy the rows into new tables in sorted order: a new table is stored in insertion order, so
+	// a sequential scan returns the rows sorted without paying for a sort in each query
+	orders := []struct {
+		table   string
+		orderBy string
+	}{
+		{"benchmark", ""},
+		{"benchmark_ascending", "ORDER BY array_length(akeys(kv), 1) ASC"},
+		{"benchmark_descending", "ORDER BY array_length(akeys(kv), 1) DESC"},
+	}
+	for _, order := range orders[1:] {
+		_, err := conn.Exec(ctx, fmt.Sprintf(
+			"CREATE TABLE %s AS SELECT kv FROM benchmark %s", order.table, order.orderBy))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var h pgtype.Hstore
+	for _, order := range orders {
+		query := "SELECT kv FROM " + order.table
+		b.Run(order.table, timeIt(func() error {
+			rows, err := conn.Query(ctx, query)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				err := rows.Scan(&h)
+				if err != nil {
+					return err
+				}
+				if len(h) == 0 {
+					return fmt.Errorf("unexpected empty hstore: %#v", h)
+				}
+			}
+			return rows.Err()
+		}))
+	}
+}
+
+func BenchmarkHstoreCountDistinctKeys(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	var expectedDistinctKeys int
+	err := conn.QueryRow(ctx, "SELECT count(DISTINCT k) FROM (SELECT skeys(kv) AS k FROM benchmark) s").Scan(
+		&expectedDistinctKeys)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("benchmark table has %d distinct keys", expectedDistinctKeys)
+
+	// queryKeySet runs query which returns one key per row and returns the set of keys
+	queryKeySet := func(query string) (map[string]struct{}, error) {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		keys := map[string]struct{}{}
+		var key string
+		for rows.Next() {
+			err := rows.Scan(&key)
+			if err != nil {
+				return nil, err
+			}
+			keys[key] = struct{}{}
+		}
+		return keys, rows.Err()
+	}
+
+	checkKeySet := func(keys map[string]struct{}) error {
+		if len(keys) != expectedDistinctKeys {
+			return fmt.Errorf("expected %d distinct keys; got %d", expectedDistinctKeys, len(keys))
+		}
+		return nil
+	}
+
+	b.Run("sql_distinct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			keys, err := queryKeySet("SELECT DISTINCT skeys(kv) FROM benchmark")
+			if err == nil {
+				err = checkKeySet(keys)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("sql_skeys", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			keys, err := queryKeySet("SELECT skeys(kv) FROM benchmark")
+			if err == nil {
+				err = checkKeySet(keys)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("go_set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			rows, err := conn.Query(ctx, "SELECT kv FROM benchmark")
+			if err != nil {
+				b.Fatal(err)
+			}
+			keys := map[string]struct{}{}
+			var h pgtype.Hstore
+			for rows.Next() {
+				err = rows.Scan(&h)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for k := range h {
+					keys[k] = struct{}{}
+				}
+			}
+			if rows.Err() != nil {
+				b.Fatal(rows.Err())
+			}
+			err = checkKeySet(keys)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkHstorePlusJSON(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// the JSON column contains the same key/value pairs as the hstore
+	_, err := conn.Exec(ctx, `CREATE TABLE benchmark_json AS
+		SELECT id, hstore_to_jsonb(kv) AS meta, kv FROM benchmark`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var meta map[string]any
+	var h pgtype.Hstore
+	queries := []struct {
+		label    string
+		query    string
+		scanArgs []any
+	}{
+		{"hstore", "SELECT kv FROM benchmark_json", []any{&h}},
+		{"json", "SELECT meta FROM benchmark_json", []any{&meta}},
+		{"json_and_hstore", "SELECT meta, kv FROM benchmark_json", []any{&meta, &h}},
+	}
+	for _, query := range queries {
+		b.Run(query.label, timeIt(func() error {
+			rows, err := conn.Query(ctx, query.query)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				err := rows.Scan(query.scanArgs...)
+				if err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		}))
+	}
+}
+
+func BenchmarkHstoreForeignKeyJoin(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// each entity has eventsPerEntity events, each one hour apart starting at startTime
+	const eventsPerEntity = 4
+	startTime := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, statement := range []struct {
+		sql  string
+		args []any
+	}{
+		{"CREATE TABLE entities (id SERIAL PRIMARY KEY, kv HSTORE)", nil},
+		{"INSERT INTO entities (kv) SELECT kv FROM benchmark ORDER BY id", nil},
+		{"CREATE TABLE events (entity_id INTEGER NOT NULL REFERENCES entities (id), ts TIMESTAMP NOT NULL)", nil},
+		{`INSERT INTO events
+			SELECT e.id, $1::timestamp + n * interval '1 hour'
+			FROM entities e, generate_series(0, $2::integer) n`, []any{startTime, eventsPerEntity - 1}},
+		{"ANALYZE", nil},
+	} {
+		_, err := conn.Exec(ctx, statement.sql, statement.args...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	// select the last half of the events for each entity
+	const query = "SELECT e.kv FROM entities e JOIN events ev ON e.id = ev.entity_id WHERE ev.ts > $1"
+	tsAfter := startTime.Add((eventsPerEntity/2 - 1) * time.Hour)
+	const expectedRows = numRows * eventsPerEntity / 2
+
+	b.Run("join", func(b *testing.B) {
+		var h pgtype.Hstore
+		for i := 0; i < b.N; i++ {
+			rows, err := conn.Query(ctx, query, tsAfter)
+			if err != nil {
+				b.Fatal(err)
+			}
+			numScanned := 0
+			for rows.Next() {
+				err = rows.Scan(&h)
+				if err != nil {
+					b.Fatal(err)
+				}
+				numScanned++
+			}
+			if rows.Err() != nil {
+				b.Fatal(rows.Err())
+			}
+			if numScanned != expectedRows {
+				b.Fatalf("expected %d rows; scanned %d", expectedRows, numScanned)
+			}
+		}
+		b.ReportMetric(float64(expectedRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+	})
+}
+
+func BenchmarkHstoreCursorPagination(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	b.Run("single_query", timeIt(func() error {
+		scanned, err := scanHstores(ctx, conn, "SELECT kv FROM benchmark")
+		if err != nil {
+			return err
+		}
+		if scanned != numRows {
+			return fmt.Errorf("expected %d rows; scanned %d", numRows, scanned)
+		}
+		return nil
+	}))
+
+	// FETCH NEXT only returns one row: FETCH FORWARD returns a page
+	const pageSize = 100
+	fetchQuery := fmt.Sprintf("FETCH FORWARD %d FROM c", pageSize)
+	b.Run(fmt.Sprintf("cursor_page_size=%d", pageSize), timeIt(func() error {
+		// cursors only exist inside a transaction
+		return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "DECLARE c CURSOR FOR SELECT kv FROM benchmark")
+			if err != nil {
+				return err
+			}
+			totalScanned := 0
+			for {
+				scanned, err := scanHstores(ctx, tx, fetchQuery)
+				if err != nil {
+					return err
+				}
+				if scanned == 0 {
+					break
+				}
+				totalScanned += scanned
+			}
+			if totalScanned != numRows {
+				return fmt.Errorf("expected %d rows; scanned %d", numRows, totalScanned)
+			}
+			return nil
+		})
+	}))
+}
+
+func BenchmarkHstoreWideTable(b *testing.B) {
+	const numIntColumns = 49
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	columns := &strings.Builder{}
+	for i := 0; i < numIntColumns; i++ {
+		fmt.Fprintf(columns, "id + %d AS c%d, ", i, i)
+	}
+	_, err := conn.Exec(ctx, "CREATE TABLE benchmark_wide AS SELECT "+columns.String()+"kv FROM benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var h pgtype.Hstore
+	ints := make([]int32, numIntColumns)
+	wideScanArgs := make([]any, 0, numIntColumns+1)
+	for i := range ints {
+		wideScanArgs = append(wideScanArgs, &ints[i])
+	}
+	wideScanArgs = append(wideScanArgs, &h)
+
+	queries := []struct {
+		label    string
+		query    string
+		scanArgs []any
+	}{
+		{"narrow", "SELECT kv FROM benchmark", []any{&h}},
+		{"wide_hstore_only", "SELECT kv FROM benchmark_wide", []any{&h}},
+		{"wide_all_columns", "SELECT * FROM benchmark_wide", wideScanArgs},
+	}
+	for _, query := range queries {
+		b.Run(query.label, timeIt(func() error {
+			rows, err := conn.Query(ctx, query.query)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				err := rows.Scan(query.scanArgs...)
+				if err != nil {
+					return err
+				}
+				if len(h) == 0 {
+					return fmt.Errorf("unexpected empty hstore: %#v", h)
+				}
+			}
+			return rows.Err()
+		}))
+	}
+}
+
+func BenchmarkHstoreAfterAddColumnDefault(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	scanRows := func(query string, numColumns int) func(b *testing.B) {
+		scanArgs := make([]any, numColumns)
+		for i := range scanArgs {
+			scanArgs[i] = &pgtype.Hstore{}
+		}
+		return timeIt(func() error {
+			rows, err := conn.Query(ctx, query)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				err := rows.Scan(scanArgs...)
+				if err != nil {
+					return err
+				}
+			}
+			return rows.Err()
+		})
+	}
+
+	// run the query before the ALTER so its statement is cached on the connection and the server
+	b.Run("before/kv", scanRows("SELECT kv FROM benchmark", 1))
+
+	// Since Postgres 11, a constant default is stored in the catalog and the table is not
+	// rewritten: existing rows get the default when they are read
+	_, err := conn.Exec(ctx, `ALTER TABLE benchmark ADD COLUMN kv2 HSTORE DEFAULT '"default"=>"value"'`)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("after/kv", scanRows("SELECT kv FROM benchmark", 1))
+	b.Run("after/kv2_default", scanRows("SELECT kv2 FROM benchmark", 1))
+	b.Run("after/kv_and_kv2", scanRows("SELECT kv, kv2 FROM benchmark", 2))
+}
+
+// genFixedString returns a random hex string with exactly length bytes.
+func genFixedString(rng *mathrand.Rand, length int) string {
+	s := &strings.Builder{}
+	for s.Len() < length {
+		fmt.Fprintf(s, "%016x", rng.Int63())
+	}
+	return s.String()[:length]
+}
+
+// genRepeatedString returns a short random string repeated to exactly length bytes. Unlike random
+// strings, Postgres can compress it.
+func genRepeatedString(rng *mathrand.Rand, length int) string {
+	return strings.Repeat(genString(rng), length)[:length]
+}
+
+func BenchmarkHstoreCacheAligned(b *testing.B) {
+	// the size of a cache line on most CPUs
+	const stringLen = 64
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "CREATE TABLE benchmark_aligned (kv HSTORE)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	for i := 0; i < numRows; i++ {
+		numPairs := 1 + rng.Intn(maxKVPairsPerRow-1)
+		h := make(pgtype.Hstore, numPairs)
+		for len(h) < numPairs {
+			value := genFixedString(rng, stringLen)
+			h[genFixedString(rng, stringLen)] = &value
+		}
+		_, err = conn.Exec(ctx, "INSERT INTO benchmark_aligned VALUES ($1)", h)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, table := range []string{"benchmark", "benchmark_aligned"} {
+		query := "SELECT kv FROM " + table
+		b.Run(table, func(b *testing.B) {
+			var totalBytes int64
+			err := conn.QueryRow(ctx, "SELECT sum(octet_length(hstore_send(kv))) FROM "+table).Scan(&totalBytes)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// report MB/s since the aligned strings are longer than the random strings
+			b.SetBytes(totalBytes)
+			for i := 0; i < b.N; i++ {
+				scanned, err := scanHstores(ctx, conn, query)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if scanned != numRows {
+					b.Fatalf("expected %d rows; scanned %d", numRows, scanned)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHstoreSQLColumnTypes(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	sqlDB := stdlib.OpenDB(*cfg)
+	b.Cleanup(func() { sqlDB.Close() })
+
+	const query = "SELECT kv FROM benchmark"
+	var h pgtype.Hstore
+	scanAll := func(withColumnTypes bool) error {
+		rows, err := sqlDB.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		if withColumnTypes {
+			columnTypes, err := rows.ColumnTypes()
+			if err != nil {
+				return err
+			}
+			if columnTypes[0].DatabaseTypeName() == "" {
+				return fmt.Errorf("unexpected empty type name for column %s", columnTypes[0].Name())
+			}
+		}
+		for rows.Next() {
+			err := rows.Scan(&h)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	b.Run("sqlScan/baseline", timeIt(func() error { return scanAll(false) }))
+	b.Run("sqlScan/with_column_types", timeIt(func() error { return scanAll(true) }))
+}
+
+// BenchmarkHstoreSelectLimit1000 scans 1000 rows: a common page size for paginated APIs, between
+// the benchmarks that scan the whole table and the ones that scan a single row.
+func BenchmarkHstoreSelectLimit1000(b *testing.B) {
+	const limit = 1000
+	const query = "SELECT kv FROM benchmark ORDER BY id LIMIT 1000"
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	var totalBytes int64
+	err := conn.QueryRow(ctx, "SELECT sum(octet_length(hstore_send(kv))) FROM ("+query+") page").Scan(&totalBytes)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(totalBytes)
+	for i := 0; i < b.N; i++ {
+		scanned, err := scanHstores(ctx, conn, query)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if scanned != limit {
+			b.Fatalf("expected %d rows; scanned %d", limit, scanned)
+		}
+	}
+	b.ReportMetric(float64(limit*b.N)/b.Elapsed().Seconds(), "rows/s")
+	b.ReportMetric(float64(totalBytes)/limit, "B/row")
+}
+
+// BenchmarkHstoreDelete deletes one row from the benchmark table, either by key existence or by
+// primary key. Each iteration inserts the row to delete first, with the timer stopped, so the
+// table keeps the same number of rows. There is no index on kv, so kv ? key scans the table.
+func BenchmarkHstoreDelete(b *testing.B) {
+	const keyToDelete = "key_to_delete"
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	value := "value"
+	row := pgtype.Hstore{keyToDelete: &value}
+
+	deletes := []struct {
+		label string
+		query string
+		byID  bool
+	}{
+		// generated keys are hex strings, so only the inserted row has keyToDelete
+		{"key_exists", "DELETE FROM benchmark WHERE kv ? '" + keyToDelete + "'", false},
+		{"id", "DELETE FROM benchmark WHERE id = $1", true},
+	}
+	for _, d := range deletes {
+		b.Run(d.label, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var id int
+				err := conn.QueryRow(ctx, "INSERT INTO benchmark (kv) VALUES ($1) RETURNING id", row).Scan(&id)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				var args []any
+				if d.byID {
+					args = append(args, id)
+				}
+				tag, err := conn.Exec(ctx, d.query, args...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if tag.RowsAffected() != 1 {
+					b.Fatalf("expected to delete 1 row; deleted %d", tag.RowsAffected())
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "deletes/s")
+		})
+	}
+}
+
+// BenchmarkHstoreWithPrewarm compares the first scan of the benchmark table to scans after
+// pg_prewarm loads it into shared_buffers. Postgres before version 17 cannot evict a table from
+// shared_buffers, and the operating system may still cache it, so the first scan is only as cold as
+// a freshly written table: it also sets hint bits on each tuple.
+func BenchmarkHstoreWithPrewarm(b *testing.B) {
+	const query = "SELECT kv FROM benchmark"
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+	_, err := conn.Exec(ctx, "CREATE EXTENSION pg_prewarm")
+	if err != nil {
+		b.Skipf("pg_prewarm extension is not available: %s", err)
+	}
+	createBenchmarkTable(b, conn)
+
+	start := time.Now()
+	scanned, err := scanHstores(ctx, conn, query)
+	if err != nil {
+		b.Fatal(err)
+	}
+	coldDuration := time.Since(start)
+	if scanned != numRows {
+		b.Fatalf("expected %d rows; scanned %d", numRows, scanned)
+	}
+
+	var blocks int64
+	err = conn.QueryRow(ctx, "SELECT pg_prewarm('benchmark')").Scan(&blocks)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("warm", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanned, err := scanHstores(ctx, conn, query)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if scanned != numRows {
+				b.Fatalf("expected %d rows; scanned %d", numRows, scanned)
+			}
+		}
+		warmNanos := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+		b.ReportMetric(float64(coldDuration.Nanoseconds()), "cold_ns")
+		b.ReportMetric(warmNanos/float64(coldDuration.Nanoseconds()), "warm/cold")
+		b.ReportMetric(float64(blocks), "prewarmed_blocks")
+	})
+}
+
+// Sizes for tables with hstores large enough that Postgres will TOAST them.
+const (
+	numLargeRows     = 1000
+	largePairsPerRow = 100
+	largeValueLen    = 256
+)
+
+// createLargeHstoreTable creates table and fills it with numLargeRows rows that each have
+// largePairsPerRow pairs, with values generated by genValue. If setColumn is not empty, it sets
+// an option on the kv column before inserting, with ALTER TABLE table ALTER COLUMN kv SET
+// setColumn (e.g. "COMPRESSION pglz" or "STORAGE EXTERNAL"). Returns the total size of the binary
+// format that Postgres sends for the kv column.
+func createLargeHstoreTable(
+	tb testing.TB, conn *pgx.Conn, table string, setColumn string,
+	genValue func(rng *mathrand.Rand) string,
+) int64 {
+	tb.Helper()
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "CREATE TABLE "+table+" (kv HSTORE)")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if setColumn != "" {
+		_, err = conn.Exec(ctx, "ALTER TABLE "+table+" ALTER COLUMN kv SET "+setColumn)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	for i := 0; i < numLargeRows; i++ {
+		h := make(pgtype.Hstore, largePairsPerRow)
+		for len(h) < largePairsPerRow {
+			value := genValue(rng)
+			h[genString(rng)] = &value
+		}
+		_, err = conn.Exec(ctx, "INSERT INTO "+table+" VALUES ($1)", h)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	// the size of the binary format sent by Postgres
+	var totalBytes int64
+	err = conn.QueryRow(ctx, "SELECT sum(octet_length(hstore_send(kv))) FROM "+table).Scan(&totalBytes)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return totalBytes
+}
+
+// benchmarkScanLargeTable scans all rows from table created by createLargeHstoreTable.
+func benchmarkScanLargeTable(b *testing.B, conn *pgx.Conn, table string, totalBytes int64) {
+	ctx := context.Background()
+	b.SetBytes(totalBytes)
+	for i := 0; i < b.N; i++ {
+		scanned, err := scanHstores(ctx, conn, "SELECT kv FROM "+table)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if scanned != numLargeRows {
+			b.Fatalf("expected %d rows; scanned %d", numLargeRows, scanned)
+		}
+	}
+	b.ReportMetric(float64(totalBytes)/numLargeRows, "B/row")
+}
+
+func BenchmarkHstoreScanLargeMap(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+
+	totalBytes := createLargeHstoreTable(b, conn, "benchmark_large", "",
+		func(rng *mathrand.Rand) string {
+			return genFixedString(rng, largeValueLen)
+		})
+
+	b.Run("scan", func(b *testing.B) {
+		benchmarkScanLargeTable(b, conn, "benchmark_large", totalBytes)
+	})
+}
+
+// BenchmarkHstoreColumnCompression compares scanning TOASTed hstores stored with different
+// column compression methods (Postgres 14+). Postgres only compresses values that are larger
+// than the TOAST threshold (about 2 kB) and that shrink by at least 25%, so the values are
+// repeated short strings, which compress well. The "uncompressed" table uses STORAGE EXTERNAL,
+// which stores values out of line without compressing them.
+func BenchmarkHstoreColumnCompression(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+
+	genRepeatedValue := func(rng *mathrand.Rand) string {
+		return genRepeatedString(rng, largeValueLen)
+	}
+
+	methods := []struct {
+		label     string
+		setColumn string
+	}{
+		{"uncompressed", "STORAGE EXTERNAL"},
+		{"pglz", "COMPRESSION pglz"},
+		{"lz4", "COMPRESSION lz4"},
+	}
+	// lz4 is only available if Postgres was built with --with-lz4
+	_, err := conn.Exec(ctx, "CREATE TABLE benchmark_lz4_check (kv HSTORE COMPRESSION lz4)")
+	lz4Supported := err == nil
+
+	for _, method := range methods {
+		if method.label == "lz4" && !lz4Supported {
+			b.Run(method.label, func(b *testing.B) {
+				b.Skip("lz4 compression is not supported by this Postgres")
+			})
+			continue
+		}
+
+		table := "benchmark_compression_" + method.label
+		totalBytes := createLargeHstoreTable(b, conn, table, method.setColumn, genRepeatedValue)
+		var tableBytes int64
+		err = conn.QueryRow(ctx, "SELECT pg_total_relation_size($1)", table).Scan(&tableBytes)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(method.label, func(b *testing.B) {
+			benchmarkScanLargeTable(b, conn, table, totalBytes)
+			b.ReportMetric(float64(tableBytes)/numLargeRows, "disk_B/row")
+		})
+	}
+}
+
+// BenchmarkHstoreCompressedVsUncompressed compares scanning TOASTed hstores of about 27 kB per
+// row stored with STORAGE EXTERNAL, which stores them out of line without compression, to STORAGE
+// MAIN, which compresses them with the default method and keeps them in the table if they fit.
+// The main sub-benchmark reports decompress_overhead_%: how much slower it is than external.
+func BenchmarkHstoreCompressedVsUncompressed(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+
+	genRepeatedValue := func(rng *mathrand.Rand) string {
+		return genRepeatedString(rng, largeValueLen)
+	}
+
+	var externalNanosPerOp float64
+	storages := []string{"external", "main"}
+	for _, storage := range storages {
+		table := "benchmark_storage_" + storage
+		totalBytes := createLargeHstoreTable(b, conn, table, "STORAGE "+strings.ToUpper(storage), genRepeatedValue)
+		var tableBytes int64
+		err := conn.QueryRow(ctx, "SELECT pg_total_relation_size($1)", table).Scan(&tableBytes)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(storage, func(b *testing.B) {
+			benchmarkScanLargeTable(b, conn, table, totalBytes)
+			b.ReportMetric(float64(tableBytes)/numLargeRows, "disk_B/row")
+
+			nanosPerOp := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+			if storage == "external" {
+				externalNanosPerOp = nanosPerOp
+			} else if externalNanosPerOp != 0 {
+				b.ReportMetric(100*(nanosPerOp-externalNanosPerOp)/externalNanosPerOp, "decompress_overhead_%")
+			}
+		})
+	}
+}
+
+func BenchmarkHstoreSequentialVsRandomAccess(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	orders := []struct {
+		label string
+		query string
+	}{
+		{"sequential", "SELECT kv FROM benchmark ORDER BY id"},
+		{"random", "SELECT kv FROM benchmark ORDER BY random()"},
+	}
+	for _, order := range orders {
+		b.Run(order.label, timeIt(func() error {
+			scanned, err := scanHstores(ctx, conn, order.query)
+			if err != nil {
+				return err
+			}
+			if scanned != numRows {
+				return fmt.Errorf("expected %d rows; scanned %d", numRows, scanned)
+			}
+			return nil
+		}))
+	}
+}
+
+func BenchmarkHstoreOrderByKey(b *testing.B) {
+	const limit = 100
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// generated keys are hex strings, so add key1 to half the rows; the rest sort as NULL
+	_, err := conn.Exec(ctx, "UPDATE benchmark SET kv = kv || hstore('key1', md5(id::text)) WHERE id % 2 = 0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	orders := []struct {
+		label string
+		query string
+	}{
+		{"unsorted", "SELECT kv FROM benchmark LIMIT 100"},
+		{"order_by_key", "SELECT kv FROM benchmark ORDER BY kv->'key1' NULLS LAST LIMIT 100"},
+	}
+	for _, order := range orders {
+		b.Run(order.label, timeIt(func() error {
+			scanned, err := scanHstores(ctx, conn, order.query)
+			if err != nil {
+				return err
+			}
+			if scanned != limit {
+				return fmt.Errorf("expected %d rows; scanned %d", limit, scanned)
+			}
+			return nil
+		}))
+	}
+}
+
+// BenchmarkHstoreVsEAV compares the benchmark table to an Entity-Attribute-Value table with the
+// same data, with one row per (entity_id, attribute). The eav sub-benchmarks report
+// hstore_speedup: the EAV time divided by the hstore time.
+func BenchmarkHstoreVsEAV(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, `CREATE TABLE benchmark_eav (
+		entity_id INT, attribute TEXT, value TEXT, PRIMARY KEY (entity_id, attribute))`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, "INSERT INTO benchmark_eav SELECT id, key, value FROM benchmark, each(kv)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, "ANALYZE benchmark_eav")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// an existing attribute for each entity
+	type entityAttribute struct {
+		id        int
+		attribute string
+	}
+	var lookups []entityAttribute
+	rows, err := conn.Query(ctx, "SELECT id, (akeys(kv))[1] FROM benchmark ORDER BY id")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for rows.Next() {
+		var lookup entityAttribute
+		err = rows.Scan(&lookup.id, &lookup.attribute)
+		if err != nil {
+			b.Fatal(err)
+		}
+		lookups = append(lookups, lookup)
+	}
+	if rows.Err() != nil {
+		b.Fatal(rows.Err())
+	}
+
+	fullRowHstore := func(lookup entityAttribute) error {
+		var h pgtype.Hstore
+		return conn.QueryRow(ctx, "SELECT kv FROM benchmark WHERE id = $1", lookup.id).Scan(&h)
+	}
+	fullRowEAV := func(lookup entityAttribute) error {
+		rows, err := conn.Query(ctx, "SELECT attribute, value FROM benchmark_eav WHERE entity_id = $1", lookup.id)
+		if err != nil {
+			return err
+		}
+		h := pgtype.Hstore{}
+		for rows.Next() {
+			var attribute string
+			var value *string
+			err = rows.Scan(&attribute, &value)
+			if err != nil {
+				return err
+			}
+			h[attribute] = value
+		}
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		if len(h) == 0 {
+			return fmt.Errorf("entity_id=%d: no attributes", lookup.id)
+		}
+		return nil
+	}
+	attributeHstore := func(lookup entityAttribute) error {
+		var value *string
+		return conn.QueryRow(ctx, "SELECT kv -> $2 FROM benchmark WHERE id = $1",
+			lookup.id, lookup.attribute).Scan(&value)
+	}
+	attributeEAV := func(lookup entityAttribute) error {
+		var value *string
+		return conn.QueryRow(ctx, "SELECT value FROM benchmark_eav WHERE entity_id = $1 AND attribute = $2",
+			lookup.id, lookup.attribute).Scan(&value)
+	}
+
+	operations := []struct {
+		label  string
+		hstore func(entityAttribute) error
+		eav    func(entityAttribute) error
+	}{
+		{"full_row", fullRowHstore, fullRowEAV},
+		{"single_attribute", attributeHstore, attributeEAV},
+	}
+	for _, operation := range operations {
+		var hstoreNanosPerOp float64
+		b.Run(operation.label+"/hstore", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := operation.hstore(lookups[i%len(lookups)])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			hstoreNanosPerOp = float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+		})
+		b.Run(operation.label+"/eav", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := operation.eav(lookups[i%len(lookups)])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			eavNanosPerOp := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+			if hstoreNanosPerOp != 0 {
+				b.ReportMetric(eavNanosPerOp/hstoreNanosPerOp, "hstore_speedup")
+			}
+		})
+	}
+}
+
+// BenchmarkHstoreScanAfterStatisticsUpdate compares scans before and after ANALYZE benchmark.
+// Before, the planner uses default estimates for the new table. It reports the planner's row
+// estimate for each query, to show whether the statistics changed.
+func BenchmarkHstoreScanAfterStatisticsUpdate(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// stop autovacuum from analyzing the table during the "before" benchmarks
+	_, err := conn.Exec(ctx, "ALTER TABLE benchmark SET (autovacuum_enabled = false)")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	queries := []struct {
+		label        string
+		query        string
+		expectedRows int
+	}{
+		{"all_rows", "SELECT kv FROM benchmark", numRows},
+		{"id_range", "SELECT kv FROM benchmark WHERE id <= 1000", 1000},
+	}
+	for _, phase := range []string{"before_analyze", "after_analyze"} {
+		if phase == "after_analyze" {
+			_, err = conn.Exec(ctx, "ANALYZE benchmark")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		for _, query := range queries {
+			var plan []map[string]any
+			err = conn.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+query.query).Scan(&plan)
+			if err != nil {
+				b.Fatal(err)
+			}
+			estimatedRows := plan[0]["Plan"].(map[string]any)["Plan Rows"].(float64)
+
+			b.Run(phase+"/"+query.label, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					scanned, err := scanHstores(ctx, conn, query.query)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if scanned != query.expectedRows {
+						b.Fatalf("expected %d rows; scanned %d", query.expectedRows, scanned)
+					}
+				}
+				b.ReportMetric(estimatedRows, "estimated_rows")
+			})
+		}
+	}
+}
+
+// BenchmarkHstoreDirectBinaryDecoder compares rows.Scan, which plans the scan with the
+// connection's pgtype.Map, to decoding the raw binary values with DirectBinaryHstore. Both use the
+// pgtype.HstoreCodec binary decoder, so the difference is the cost of dispatching through the Map.
+func BenchmarkHstoreDirectBinaryDecoder(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	const query = "SELECT kv FROM benchmark"
+	typeMapScan := func() error {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		var h pgtype.Hstore
+		for rows.Next() {
+			err = rows.Scan(&h)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	directDecode := func() error {
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+		var h DirectBinaryHstore
+		var decoder BinaryDecoder = &h
+		for rows.Next() {
+			if rows.FieldDescriptions()[0].Format != pgtype.BinaryFormatCode {
+				rows.Close()
+				return errors.New("expected the binary format")
+			}
+			err = decoder.DecodeBinary(rows.RawValues()[0])
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	b.Run("type_map_scan", timeIt(typeMapScan))
+	b.Run("direct_binary_decoder", timeIt(directDecode))
+}
+
+// BenchmarkHstoreAggregation builds one large hstore from all rows in the benchmark table. Postgres
+// has no hstore_agg function, so it aggregates the pairs from each(kv) into arrays and calls
+// hstore(keys, values). Aggregating with the || operator copies the hstore for each row, which
+// is quadratic. Duplicate keys keep only one value. The decode sub-benchmark only decodes the
+// result, without the query.
+func BenchmarkHstoreAggregation(b *testing.B) {
+	const aggregateQuery = "SELECT hstore(array_agg(key), array_agg(value)) FROM benchmark, each(kv)"
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	var encoded []byte
+	err := conn.QueryRow(ctx, "SELECT hstore_send(("+aggregateQuery+"))").Scan(&encoded)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var aggregated pgtype.Hstore
+	scanPlan := pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &aggregated)
+	err = scanPlan.Scan(encoded, &aggregated)
+	if err != nil {
+		b.Fatal(err)
+	}
+	numPairs := len(aggregated)
+
+	b.Run("query", func(b *testing.B) {
+		b.SetBytes(int64(len(encoded)))
+		for i := 0; i < b.N; i++ {
+			var h pgtype.Hstore
+			err := conn.QueryRow(ctx, aggregateQuery).Scan(&h)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(h) != numPairs {
+				b.Fatalf("expected %d pairs; scanned %d", numPairs, len(h))
+			}
+		}
+		b.ReportMetric(float64(numPairs), "pairs")
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.SetBytes(int64(len(encoded)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := scanPlan.Scan(encoded, &aggregated)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(numPairs), "pairs")
+	})
+}
+
+// ramTablespaceDir is a RAM-backed file system on most Linux systems.
+const ramTablespaceDir = "/dev/shm"
+
+// BenchmarkHstoreMemoryMappedTablespace compares scanning the benchmark table in the default
+// tablespace to a copy in a tablespace in ramTablespaceDir. postgrestest puts the data directory
+// in os.TempDir, which may also be RAM-backed. Both tables fit in shared_buffers, so repeated
+// scans mostly measure the copy from shared_buffers, not the storage.
+func BenchmarkHstoreMemoryMappedTablespace(b *testing.B) {
+	skipWithoutPostgres(b)
+	if _, err := os.Stat(ramTablespaceDir); err != nil {
+		b.Skipf("RAM-backed directory not available: %s", err)
+	}
+	// created before Postgres starts, so it is removed after Postgres is shut down
+	tablespaceDir, err := os.MkdirTemp(ramTablespaceDir, "hstorebench_")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { os.RemoveAll(tablespaceDir) })
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	_, err = conn.Exec(ctx, "CREATE TABLESPACE ram_tablespace LOCATION '"+tablespaceDir+"'")
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, "CREATE TABLE benchmark_ram TABLESPACE ram_tablespace AS SELECT * FROM benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, table := range []string{"benchmark", "benchmark_ram"} {
+		query := "SELECT kv FROM " + table
+		b.Run(table, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scanned, err := scanHstores(ctx, conn, query)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if scanned != numRows {
+					b.Fatalf("expected %d rows; scanned %d", numRows, scanned)
+				}
+			}
+			b.ReportMetric(float64(numRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
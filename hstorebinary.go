@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const uint32Len = 4
+
+// minBinaryPairLen is the smallest encoded length of a key/value pair: the key and value lengths.
+const minBinaryPairLen = 2 * uint32Len
+
+// errHstoreTrailingBytes is returned by decodeHstoreBinary if there are bytes after the last pair.
+// The pgtype and pgxtypefaster decoders ignore them.
+var errHstoreTrailingBytes = errors.New("hstore has unexpected trailing bytes")
+
+// copyString returns a new string containing a copy of b.
+func copyString(b []byte) string {
+	return string(b)
+}
+
+// decodeHstoreBinary decodes the Postgres binary hstore format. It is a copy of the pgtype binary
+// scan plan, except it calls newKey and newValue to create the strings, so benchmarks can compare
+// ways to allocate them. Pass copyString for the same behaviour as pgtype. It returns nil for nil
+// src, which is a NULL hstore.
+func decodeHstoreBinary(src []byte, newKey func([]byte) string, newValue func([]byte) string) (pgtype.Hstore, error) {
+	if src == nil {
+		return nil, nil
+	}
+
+	rp := 0
+	if len(src) < uint32Len {
+		return nil, fmt.Errorf("hstore incomplete %v", src)
+	}
+	pairCount := int(int32(binary.BigEndian.Uint32(src[rp:])))
+	rp += uint32Len
+
+	// check the count before allocating: a corrupt count must not cause a huge allocation
+	if pairCount < 0 || pairCount > len(src[rp:])/minBinaryPairLen {
+		return nil, fmt.Errorf("hstore invalid pair count %d for %d bytes", pairCount, len(src))
+	}
+
+	hstore := make(pgtype.Hstore, pairCount)
+	// one allocation for all *string, rather than one per string
+	valueStrings := make([]string, pairCount)
+
+	for i := 0; i < pairCount; i++ {
+		if len(src[rp:]) < uint32Len {
+			return nil, fmt.Errorf("hstore incomplete %v", src)
+		}
+		keyLen := int(int32(binary.BigEndian.Uint32(src[rp:])))
+		rp += uint32Len
+
+		if keyLen < 0 || len(src[rp:]) < keyLen {
+			return nil, fmt.Errorf("hstore incomplete %v", src)
+		}
+		key := newKey(src[rp : rp+keyLen])
+		rp += keyLen
+
+		if len(src[rp:]) < uint32Len {
+			return nil, fmt.Errorf("hstore incomplete %v", src)
+		}
+		valueLen := int(int32(binary.BigEndian.Uint32(src[rp:])))
+		rp += uint32Len
+
+		if valueLen >= 0 {
+			if len(src[rp:]) < valueLen {
+				return nil, fmt.Errorf("hstore incomplete %v", src)
+			}
+			valueStrings[i] = newValue(src[rp : rp+valueLen])
+			rp += valueLen
+			hstore[key] = &valueStrings[i]
+		} else {
+			hstore[key] = nil
+		}
+	}
+	if rp != len(src) {
+		return nil, fmt.Errorf("%w: %d bytes", errHstoreTrailingBytes, len(src)-rp)
+	}
+
+	return hstore, nil
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/evanj/pgxtypefaster"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// encodeHstoreBinary returns h in the Postgres binary format, using the pgtype codec.
+func encodeHstoreBinary(tb testing.TB, h pgtype.Hstore) []byte {
+	plan := pgtype.HstoreCodec{}.PlanEncode(nil, 0, pgtype.BinaryFormatCode, h)
+	out, err := plan.Encode(h, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return out
+}
+
+func TestDecodeHstoreBinary(t *testing.T) {
+	for i, h := range roundTripHstores {
+		encoded := encodeHstoreBinary(t, h)
+		out, err := decodeHstoreBinary(encoded, copyString, copyString)
+		if err != nil {
+			t.Errorf("%d: decodeHstoreBinary(%#v) err=%s", i, encoded, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: decodeHstoreBinary(%#v)=%#v; expected %#v", i, encoded, out, h)
+		}
+
+		// every truncated encoding must fail
+		for j := 0; j < len(encoded); j++ {
+			out, err := decodeHstoreBinary(encoded[:j], copyString, copyString)
+			if err == nil {
+				t.Errorf("%d: decodeHstoreBinary(%#v)=%#v; expected error", i, encoded[:j], out)
+			}
+		}
+	}
+
+	out, err := decodeHstoreBinary(nil, copyString, copyString)
+	if !(out == nil && err == nil) {
+		t.Errorf("decodeHstoreBinary(nil)=%#v, %#v; expected nil, nil", out, err)
+	}
+}
+
+// stringInterner returns the same string for equal byte slices. It is safe for concurrent use.
+// Decoders should use a localStringInterner from newLocal, which avoids allocating for strings
+// that are already interned.
+type stringInterner struct {
+	strings sync.Map
+}
+
+func (s *stringInterner) intern(b []byte) string {
+	str := string(b)
+	interned, _ := s.strings.LoadOrStore(str, str)
+	return interned.(string)
+}
+
+// newLocal returns a localStringInterner that shares strings with s.
+func (s *stringInterner) newLocal() *localStringInterner {
+	return &localStringInterner{s, map[string]string{}}
+}
+
+// localStringInterner caches strings from a shared stringInterner in a map. It is not safe for
+// concurrent use, so each decoder must have its own.
+type localStringInterner struct {
+	shared  *stringInterner
+	strings map[string]string
+}
+
+func (l *localStringInterner) intern(b []byte) string {
+	// the compiler does not allocate for a map lookup with string(b)
+	str, ok := l.strings[string(b)]
+	if ok {
+		return str
+	}
+	str = l.shared.intern(b)
+	l.strings[str] = str
+	return str
+}
+
+// genSharedKeyHstores returns n hstores that all have the same numKeys keys with random values.
+func genSharedKeyHstores(n int, numKeys int) []pgtype.Hstore {
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	hstores := make([]pgtype.Hstore, n)
+	for i := range hstores {
+		h := make(pgtype.Hstore, numKeys)
+		for j := 0; j < numKeys; j++ {
+			value := genString(rng)
+			h[fmt.Sprintf("key%d", j)] = &value
+		}
+		hstores[i] = h
+	}
+	return hstores
+}
+
+func BenchmarkHstoreParseVsInternedKeys(b *testing.B) {
+	hstores := genSharedKeyHstores(1000, maxKVPairsPerRow)
+	encoded := make([][]byte, len(hstores))
+	for i, h := range hstores {
+		encoded[i] = encodeHstoreBinary(b, h)
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := decodeHstoreBinary(encoded[i%len(encoded)], copyString, copyString)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("interned", func(b *testing.B) {
+		interner := (&stringInterner{}).newLocal()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := decodeHstoreBinary(encoded[i%len(encoded)], interner.intern, copyString)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// stringSlab allocates strings by copying them into large shared byte slices, which reduces the
+// number of allocations. A slab is freed by the garbage collector when no strings refer to it.
+// This is safe because bytes are never modified after they are returned as a string.
+type stringSlab struct {
+	buf []byte
+}
+
+const stringSlabSize = 4096
+
+func (s *stringSlab) newString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	if len(b) > stringSlabSize/4 {
+		// large strings get their own allocation to avoid wasting the rest of a slab
+		return string(b)
+	}
+	if cap(s.buf)-len(s.buf) < len(b) {
+		s.buf = make([]byte, 0, stringSlabSize)
+	}
+	start := len(s.buf)
+	s.buf = append(s.buf, b...)
+	return unsafe.String(&s.buf[start], len(b))
+}
+
+func TestStringSlab(t *testing.T) {
+	slab := &stringSlab{}
+	var strs []string
+	var expected []string
+	for i := 0; i < 2000; i++ {
+		s := fmt.Sprintf("string %d", i)
+		b := []byte(s)
+		strs = append(strs, slab.newString(b))
+		expected = append(expected, s)
+		// modifying the input must not change the output
+		b[0] = 'X'
+	}
+	long := string(make([]byte, stringSlabSize))
+	strs = append(strs, slab.newString([]byte(long)), slab.newString(nil))
+	expected = append(expected, long, "")
+
+	if !reflect.DeepEqual(strs, expected) {
+		t.Error("stringSlab returned unexpected strings")
+	}
+}
+
+func BenchmarkHstoreWithCustomStringAlloc(b *testing.B) {
+	hstores := genHstores(1000)
+	encoded := make([][]byte, len(hstores))
+	for i, h := range hstores {
+		encoded[i] = encodeHstoreBinary(b, h)
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := decodeHstoreBinary(encoded[i%len(encoded)], copyString, copyString)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("slab", func(b *testing.B) {
+		slab := &stringSlab{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := decodeHstoreBinary(encoded[i%len(encoded)], slab.newString, slab.newString)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// keyValueBinary is the binary encoding of '"key"=>"value"'::hstore produced by Postgres 15.
+var keyValueBinary = []byte{
+	0x00, 0x00, 0x00, 0x01, // pair count
+	0x00, 0x00, 0x00, 0x03, 'k', 'e', 'y', // key length, key
+	0x00, 0x00, 0x00, 0x05, 'v', 'a', 'l', 'u', 'e', // value length, value
+}
+
+func TestHstoreRawBinaryFormatValidation(t *testing.T) {
+	var h pgxtypefaster.Hstore
+	plan := pgxtypefaster.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &h)
+	err := plan.Scan(keyValueBinary, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pgxtypefaster.Hstore{"key": pgxtypefaster.NewText("value")}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("pgxtypefaster decoded %#v; expected %#v", h, expected)
+	}
+
+	var pgxHstore pgtype.Hstore
+	plan = pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgxHstore)
+	err = plan.Scan(keyValueBinary, &pgxHstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPGX := pgtype.Hstore{"key": stringPtr("value")}
+	if !reflect.DeepEqual(pgxHstore, expectedPGX) {
+		t.Errorf("pgtype decoded %#v; expected %#v", pgxHstore, expectedPGX)
+	}
+
+	// the encoders must produce the same bytes
+	encoded := encodeWithCodec(t, pgxtypefaster.HstoreCodec{}, expected)
+	if !bytes.Equal(encoded, keyValueBinary) {
+		t.Errorf("pgxtypefaster encoded %#v; expected %#v", encoded, keyValueBinary)
+	}
+	encoded = encodeHstoreBinary(t, expectedPGX)
+	if !bytes.Equal(encoded, keyValueBinary) {
+		t.Errorf("pgtype encoded %#v; expected %#v", encoded, keyValueBinary)
+	}
+}
+
+func BenchmarkHstoreByNumPairs(b *testing.B) {
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	for _, numPairs := range []int{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000} {
+		encoded := encodeHstoreBinary(b, genHstore(rng, numPairs))
+
+		var pgxHstore pgtype.Hstore
+		var fasterHstore pgxtypefaster.Hstore
+		decoders := []struct {
+			label  string
+			plan   pgtype.ScanPlan
+			target any
+		}{
+			{"pgtype", pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgxHstore), &pgxHstore},
+			{"pgxtypefaster", pgxtypefaster.HstoreCodec{}.PlanScan(
+				nil, 0, pgtype.BinaryFormatCode, &fasterHstore), &fasterHstore},
+		}
+		for _, decoder := range decoders {
+			b.Run(fmt.Sprintf("%s/pairs=%d", decoder.label, numPairs), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					err := decoder.plan.Scan(encoded, decoder.target)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*numPairs), "ns/pair")
+			})
+		}
+	}
+}
+
+func BenchmarkHstorePureDecodeComparison(b *testing.B) {
+	// the same distribution of hstores as the benchmark table, without any I/O
+	hstores := genHstores(numRows)
+	encoded := make([][]byte, len(hstores))
+	for i, h := range hstores {
+		encoded[i] = encodeHstoreBinary(b, h)
+	}
+
+	var pgxHstore pgtype.Hstore
+	var fasterHstore pgxtypefaster.Hstore
+	decoders := []struct {
+		label  string
+		plan   pgtype.ScanPlan
+		target any
+	}{
+		{"pgtype", pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgxHstore), &pgxHstore},
+		{"pgxtypefaster", pgxtypefaster.HstoreCodec{}.PlanScan(
+			nil, 0, pgtype.BinaryFormatCode, &fasterHstore), &fasterHstore},
+	}
+	for _, decoder := range decoders {
+		b.Run(decoder.label, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := decoder.plan.Scan(encoded[i%len(encoded)], decoder.target)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// unsafeString returns a string that shares memory with b, without copying it.
+//
+// SAFETY: The string is only valid while b is not modified. Decoding an hstore from a pgx row with
+// this is unsafe: pgx reuses its read buffer for the next row, which silently changes the strings.
+// It is only safe if b is owned by the caller and never modified, like the encoded values below.
+func unsafeString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return unsafe.String((*byte)(unsafe.Pointer(&b[0])), len(b))
+}
+
+func BenchmarkHstoreUnsafeStrings(b *testing.B) {
+	hstores := genHstores(1000)
+	encoded := make([][]byte, len(hstores))
+	for i, h := range hstores {
+		encoded[i] = encodeHstoreBinary(b, h)
+	}
+
+	decoders := []struct {
+		label     string
+		newString func([]byte) string
+	}{
+		{"copy", copyString},
+		{"unsafe_zero_copy", unsafeString},
+	}
+	for _, decoder := range decoders {
+		b.Run(decoder.label, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := decodeHstoreBinary(encoded[i%len(encoded)], decoder.newString, decoder.newString)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// corruptPairCounts are pair counts larger than the single pair in buffers from corruptPairsBuffer.
+var corruptPairCounts = []uint32{math.MaxInt32, math.MaxUint32, 0x80000000, 2}
+
+// corruptPairsBuffer returns a binary hstore that claims to have pairCount pairs, but has one.
+func corruptPairsBuffer(pairCount uint32) []byte {
+	encoded := binary.BigEndian.AppendUint32(nil, pairCount)
+	return append(encoded, 0, 0, 0, 1, 'k', 0, 0, 0, 1, 'v')
+}
+
+// scanCorruptPairs scans corruptPairsBuffer(pairCount) with plan into target. It returns the
+// scan error, or an error describing the panic if the plan panics.
+func scanCorruptPairs(plan pgtype.ScanPlan, pairCount uint32, target any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return plan.Scan(corruptPairsBuffer(pairCount), target)
+}
+
+// TestHstoreMaxPairsLimit records how pgtype.HstoreCodec and pgxtypefaster.HstoreCodec handle a
+// binary hstore with a corrupt pair count. Both call make with the pair count before checking that
+// the buffer is long enough. This is an upstream bug:
+//
+//   - pgtype panics for a negative count, since it also makes a []string with the count
+//   - pgxtypefaster returns an empty hstore with no error for a negative count
+//   - both allocate gigabytes for a count near math.MaxInt32, so that case is not tested
+//
+// If this test fails, the upstream behaviour changed: update the expected results.
+func TestHstoreMaxPairsLimit(t *testing.T) {
+	const pgtypePanic = "panic: runtime error: makeslice: len out of range"
+	const incomplete = "hstore incomplete"
+	tests := []struct {
+		pairCount     uint32
+		pgtypeErr     string
+		fasterErr     string
+		fasterDecoded pgxtypefaster.Hstore
+	}{
+		{math.MaxUint32, pgtypePanic, "", pgxtypefaster.Hstore{}},
+		{0x80000000, pgtypePanic, "", pgxtypefaster.Hstore{}},
+		{2, incomplete, incomplete, nil},
+		{1 << 16, incomplete, incomplete, nil},
+	}
+
+	var pgtypeHstore pgtype.Hstore
+	pgtypePlan := pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgtypeHstore)
+	var fasterHstore pgxtypefaster.Hstore
+	fasterPlan := pgxtypefaster.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &fasterHstore)
+	errString := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	for _, test := range tests {
+		err := scanCorruptPairs(pgtypePlan, test.pairCount, &pgtypeHstore)
+		if !strings.HasPrefix(errString(err), test.pgtypeErr) || (err == nil) != (test.pgtypeErr == "") {
+			t.Errorf("pairCount=%d: pgtype err=%v; expected %#v", test.pairCount, err, test.pgtypeErr)
+		}
+
+		fasterHstore = nil
+		err = scanCorruptPairs(fasterPlan, test.pairCount, &fasterHstore)
+		if !strings.HasPrefix(errString(err), test.fasterErr) || (err == nil) != (test.fasterErr == "") {
+			t.Errorf("pairCount=%d: pgxtypefaster err=%v; expected %#v", test.pairCount, err, test.fasterErr)
+		}
+		if err == nil && !reflect.DeepEqual(fasterHstore, test.fasterDecoded) {
+			t.Errorf("pairCount=%d: pgxtypefaster decoded %#v; expected %#v",
+				test.pairCount, fasterHstore, test.fasterDecoded)
+		}
+	}
+}
+
+// TestDecodeHstoreBinaryMaxPairs checks that decodeHstoreBinary checks the pair count against the
+// length of the buffer before allocating, unlike the codecs in TestHstoreMaxPairsLimit.
+func TestDecodeHstoreBinaryMaxPairs(t *testing.T) {
+	for _, pairCount := range corruptPairCounts {
+		out, err := decodeHstoreBinary(corruptPairsBuffer(pairCount), copyString, copyString)
+		if err == nil {
+			t.Errorf("pairCount=%d: decodeHstoreBinary=%#v; expected error", pairCount, out)
+		}
+	}
+}
+
+// FuzzHstoreBinaryCodec checks that the pgxtypefaster decoder returns the same result and error as
+// decodeHstoreBinary for any input, and that any input decodeHstoreBinary accepts is also accepted
+// by the pgtype decoder with the same result, and re-encodes to an equal hstore. A panic in the
+// pgxtypefaster decoder fails the test: it currently panics for a value length longer than the
+// remaining input, since it does not check it. The upstream decoders allocate using the pair count before
+// checking it (see TestHstoreMaxPairsLimit), so they are not called with counts that
+// decodeHstoreBinary rejects.
+func FuzzHstoreBinaryCodec(f *testing.F) {
+	for _, h := range roundTripHstores {
+		f.Add(encodeHstoreBinary(f, h))
+	}
+	f.Add(encodeHstoreBinary(f, pgtype.Hstore{"k": stringPtr("a\x00b"), "a\x00b": nil}))
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 1, 'k', 0xff, 0xff, 0xff, 0xff})
+
+	scanPlan := pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgtype.Hstore{})
+	fasterScanPlan := pgxtypefaster.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgxtypefaster.Hstore{})
+	f.Fuzz(func(t *testing.T, encoded []byte) {
+		decoded, err := decodeHstoreBinary(encoded, copyString, copyString)
+
+		// the upstream decoders ignore trailing bytes, so their results are not comparable
+		if validPairCount(encoded) && !errors.Is(err, errHstoreTrailingBytes) {
+			var fasterDecoded pgxtypefaster.Hstore
+			fasterErr := func() (err error) {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("pgxtypefaster decode(%#v) panicked: %v", encoded, r)
+					}
+				}()
+				return fasterScanPlan.Scan(encoded, &fasterDecoded)
+			}()
+			if (err == nil) != (fasterErr == nil) {
+				t.Fatalf("pgxtypefaster decode(%#v) err=%v; decodeHstoreBinary err=%v", encoded, fasterErr, err)
+			}
+			var expected pgxtypefaster.Hstore
+			if decoded != nil {
+				expected = pgxtypefaster.PGXToFasterHstore(decoded)
+			}
+			if err == nil && !reflect.DeepEqual(fasterDecoded, expected) {
+				t.Fatalf("pgxtypefaster decode(%#v)=%#v; decodeHstoreBinary=%#v", encoded, fasterDecoded, decoded)
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		var pgtypeDecoded pgtype.Hstore
+		err = scanPlan.Scan(encoded, &pgtypeDecoded)
+		if err != nil {
+			t.Fatalf("pgtype decode(%#v) err=%s; decodeHstoreBinary=%#v", encoded, err, decoded)
+		}
+		if !reflect.DeepEqual(decoded, pgtypeDecoded) {
+			t.Fatalf("pgtype decode(%#v)=%#v; decodeHstoreBinary=%#v", encoded, pgtypeDecoded, decoded)
+		}
+
+		reencoded := encodeHstoreBinary(t, decoded)
+		roundTrip, err := decodeHstoreBinary(reencoded, copyString, copyString)
+		if err != nil {
+			t.Fatalf("decode(encode(%#v)) err=%s", decoded, err)
+		}
+		if !reflect.DeepEqual(decoded, roundTrip) {
+			t.Fatalf("decode(encode(%#v))=%#v", decoded, roundTrip)
+		}
+	})
+}
+
+// validPairCount returns false if encoded has a pair count that decodeHstoreBinary rejects because
+// it is negative or larger than the number of pairs that fit in encoded.
+func validPairCount(encoded []byte) bool {
+	if len(encoded) < uint32Len {
+		return true
+	}
+	pairCount := int(int32(binary.BigEndian.Uint32(encoded)))
+	return pairCount >= 0 && pairCount <= len(encoded[uint32Len:])/minBinaryPairLen
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// RowQuerier runs a query that returns a single row. It is implemented by *pgx.Conn, pgx.Tx, and
+// *pgxpool.Pool.
+type RowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// CachedHstoreLoader loads hstores by id and caches them in memory. The cached hstores are shared
+// by all callers, so they must not be modified. Callers must call Invalidate after changing a row.
+// Load and Invalidate are safe to call concurrently if Querier is, like a *pgxpool.Pool. A *pgx.Conn
+// is not safe for concurrent use.
+type CachedHstoreLoader struct {
+	Querier RowQuerier
+	// Query selects a single hstore column for the id passed as $1.
+	Query string
+	// Cache maps int ids to pgtype.Hstore values, or to a *pendingLoad while Load is querying.
+	Cache sync.Map
+}
+
+// pendingLoad is stored in CachedHstoreLoader.Cache while Load queries the database. Invalidate
+// deletes it, so Load does not cache a row that was changed while it was querying.
+type pendingLoad struct{}
+
+// Load returns the hstore for id from the cache, or queries the database if it is not cached. It
+// returns pgx.ErrNoRows if the row does not exist. Concurrent calls for an id that is not cached may
+// all query the database, but only the last one to start caches its result.
+func (c *CachedHstoreLoader) Load(ctx context.Context, id int) (pgtype.Hstore, error) {
+	pending := &pendingLoad{}
+	for {
+		cached, loaded := c.Cache.LoadOrStore(id, pending)
+		if !loaded {
+			break
+		}
+		h, ok := cached.(pgtype.Hstore)
+		if ok {
+			return h, nil
+		}
+		// another Load is querying: replace its pendingLoad so it does not cache its result
+		if c.Cache.CompareAndSwap(id, cached, pending) {
+			break
+		}
+	}
+
+	var h pgtype.Hstore
+	err := c.Querier.QueryRow(ctx, c.Query, id).Scan(&h)
+	if err != nil {
+		c.Cache.CompareAndDelete(id, pending)
+		return nil, err
+	}
+	// does nothing if Invalidate or another Load replaced pending
+	c.Cache.CompareAndSwap(id, pending, h)
+	return h, nil
+}
+
+// Invalidate removes id from the cache, so the next Load queries the database.
+func (c *CachedHstoreLoader) Invalidate(id int) {
+	c.Cache.Delete(id)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const selectKVByID = "SELECT kv FROM benchmark WHERE id = $1"
+
+// countingQuerier counts the queries passed to a RowQuerier.
+type countingQuerier struct {
+	RowQuerier
+	queries atomic.Int64
+}
+
+func (c *countingQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	c.queries.Add(1)
+	return c.RowQuerier.QueryRow(ctx, sql, args...)
+}
+
+func TestCachedHstoreLoader(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	ctx := context.Background()
+	_, err := conn.Exec(ctx, `CREATE TABLE benchmark (id INTEGER PRIMARY KEY, kv HSTORE);
+		INSERT INTO benchmark VALUES (1, 'k=>v1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	querier := &countingQuerier{RowQuerier: newHstorePool(t, cfg, 4)}
+	loader := &CachedHstoreLoader{Querier: querier, Query: selectKVByID}
+	expectLoad := func(id int, expected pgtype.Hstore, expectedQueries int64) {
+		t.Helper()
+		startQueries := querier.queries.Load()
+		h, err := loader.Load(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h, expected) {
+			t.Errorf("Load(%d)=%#v; expected %#v", id, h, expected)
+		}
+		queries := querier.queries.Load() - startQueries
+		if queries != expectedQueries {
+			t.Errorf("Load(%d) ran %d queries; expected %d", id, queries, expectedQueries)
+		}
+	}
+	expectLoad(1, pgtype.Hstore{"k": stringPtr("v1")}, 1)
+	expectLoad(1, pgtype.Hstore{"k": stringPtr("v1")}, 0)
+
+	_, err = conn.Exec(ctx, `UPDATE benchmark SET kv = 'k=>v2' WHERE id = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the cached value is returned until it is invalidated
+	expectLoad(1, pgtype.Hstore{"k": stringPtr("v1")}, 0)
+	loader.Invalidate(1)
+	expectLoad(1, pgtype.Hstore{"k": stringPtr("v2")}, 1)
+
+	// rows that do not exist are not cached
+	h, err := loader.Load(ctx, 2)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("Load(2)=%#v, %#v; expected pgx.ErrNoRows", h, err)
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO benchmark VALUES (2, 'k=>new')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad(2, pgtype.Hstore{"k": stringPtr("new")}, 1)
+
+	// concurrent loads with a pool
+	loader.Invalidate(1)
+	loader.Invalidate(2)
+	const goroutines = 8
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func(id int) {
+			_, err := loader.Load(ctx, id)
+			errs <- err
+		}(1 + i%2)
+	}
+	for i := 0; i < goroutines; i++ {
+		err := <-errs
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	expectLoad(1, pgtype.Hstore{"k": stringPtr("v2")}, 0)
+	expectLoad(2, pgtype.Hstore{"k": stringPtr("new")}, 0)
+}
+
+func BenchmarkCachedHstoreLoader(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	b.Run("uncached", timeIt(func() error {
+		var h pgtype.Hstore
+		for id := 1; id <= 100; id++ {
+			err := conn.QueryRow(ctx, selectKVByID, id).Scan(&h)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	loader := &CachedHstoreLoader{Querier: conn, Query: selectKVByID}
+	b.Run("cached", timeIt(func() error {
+		for id := 1; id <= 100; id++ {
+			_, err := loader.Load(ctx, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// funcRow is a pgx.Row that calls scan.
+type funcRow func(dest ...any) error
+
+func (f funcRow) Scan(dest ...any) error {
+	return f(dest...)
+}
+
+// funcQuerier is a RowQuerier that returns rows that call scan.
+type funcQuerier func(dest ...any) error
+
+func (f funcQuerier) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return funcRow(f)
+}
+
+func TestCachedHstoreLoaderInvalidateDuringLoad(t *testing.T) {
+	ctx := context.Background()
+	row := pgtype.Hstore{"k": stringPtr("v1")}
+	var afterScan func()
+	queries := 0
+	loader := &CachedHstoreLoader{}
+	loader.Querier = funcQuerier(func(dest ...any) error {
+		queries++
+		*dest[0].(*pgtype.Hstore) = row
+		if afterScan != nil {
+			afterScan()
+		}
+		return nil
+	})
+
+	// the row changes and is invalidated after Load queries it, but before Load caches it
+	afterScan = func() {
+		afterScan = nil
+		row = pgtype.Hstore{"k": stringPtr("v2")}
+		loader.Invalidate(1)
+	}
+	h, err := loader.Load(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, pgtype.Hstore{"k": stringPtr("v1")}) {
+		t.Errorf("Load(1)=%#v; expected the value before the update", h)
+	}
+
+	// the stale value must not be cached
+	for i := 0; i < 2; i++ {
+		h, err = loader.Load(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h, row) {
+			t.Errorf("Load(1)=%#v; expected %#v", h, row)
+		}
+	}
+	if queries != 2 {
+		t.Errorf("Load ran %d queries; expected 2", queries)
+	}
+
+	// a Load that starts while another is querying replaces it
+	loader.Invalidate(1)
+	afterScan = func() {
+		afterScan = nil
+		row = pgtype.Hstore{"k": stringPtr("v3")}
+		_, err := loader.Load(ctx, 1)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = loader.Load(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := loader.Cache.Load(1)
+	if !reflect.DeepEqual(cached, row) {
+		t.Errorf("cached %#v; expected the result of the second Load %#v", cached, row)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql/driver"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evanj/pgxtypefaster"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Compressor compresses and decompresses byte slices.
+type Compressor interface {
+	// Compress appends the compressed src to dst and returns the new slice.
+	Compress(dst []byte, src []byte) ([]byte, error)
+	// Decompress returns the decompressed src.
+	Decompress(src []byte) ([]byte, error)
+}
+
+// GzipCompressor implements Compressor with compress/gzip.
+type GzipCompressor struct {
+	// Level is passed to gzip.NewWriterLevel. The zero value is gzip.NoCompression, so callers
+	// should usually set it to gzip.DefaultCompression.
+	Level int
+}
+
+// Compress implements Compressor.
+func (g GzipCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := gzip.NewWriterLevel(buf, g.Level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor.
+func (GzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// CompressedHstoreCodec is a pgtype.Codec that stores the binary hstore format compressed by
+// Compressor. Postgres cannot read this format as an hstore, so it must be used with a bytea
+// column. It only supports the binary format.
+type CompressedHstoreCodec struct {
+	Codec      pgxtypefaster.HstoreCodec
+	Compressor Compressor
+}
+
+// FormatSupported implements pgtype.Codec.
+func (CompressedHstoreCodec) FormatSupported(format int16) bool {
+	return format == pgtype.BinaryFormatCode
+}
+
+// PreferredFormat implements pgtype.Codec.
+func (CompressedHstoreCodec) PreferredFormat() int16 {
+	return pgtype.BinaryFormatCode
+}
+
+// PlanEncode implements pgtype.Codec.
+func (c CompressedHstoreCodec) PlanEncode(m *pgtype.Map, oid uint32, format int16, value any) pgtype.EncodePlan {
+	if format != pgtype.BinaryFormatCode {
+		return nil
+	}
+	plan := c.Codec.PlanEncode(m, oid, format, value)
+	if plan == nil {
+		return nil
+	}
+	return &encodePlanCompressed{plan, c.Compressor}
+}
+
+type encodePlanCompressed struct {
+	plan       pgtype.EncodePlan
+	compressor Compressor
+}
+
+func (e *encodePlanCompressed) Encode(value any, buf []byte) (newBuf []byte, err error) {
+	uncompressed, err := e.plan.Encode(value, nil)
+	if err != nil {
+		return nil, err
+	}
+	if uncompressed == nil {
+		// NULL
+		return nil, nil
+	}
+	return e.compressor.Compress(buf, uncompressed)
+}
+
+// PlanScan implements pgtype.Codec.
+func (c CompressedHstoreCodec) PlanScan(m *pgtype.Map, oid uint32, format int16, target any) pgtype.ScanPlan {
+	if format != pgtype.BinaryFormatCode {
+		return nil
+	}
+	plan := c.Codec.PlanScan(m, oid, format, target)
+	if plan == nil {
+		return nil
+	}
+	return &scanPlanCompressed{plan, c.Compressor}
+}
+
+type scanPlanCompressed struct {
+	plan       pgtype.ScanPlan
+	compressor Compressor
+}
+
+func (s *scanPlanCompressed) Scan(src []byte, dst any) error {
+	if src == nil {
+		return s.plan.Scan(nil, dst)
+	}
+	uncompressed, err := s.compressor.Decompress(src)
+	if err != nil {
+		return err
+	}
+	return s.plan.Scan(uncompressed, dst)
+}
+
+// DecodeDatabaseSQLValue implements pgtype.Codec.
+func (c CompressedHstoreCodec) DecodeDatabaseSQLValue(m *pgtype.Map, oid uint32, format int16, src []byte) (driver.Value, error) {
+	if src == nil {
+		return nil, nil
+	}
+	uncompressed, err := c.Compressor.Decompress(src)
+	if err != nil {
+		return nil, err
+	}
+	return c.Codec.DecodeDatabaseSQLValue(m, oid, format, uncompressed)
+}
+
+// DecodeValue implements pgtype.Codec.
+func (c CompressedHstoreCodec) DecodeValue(m *pgtype.Map, oid uint32, format int16, src []byte) (any, error) {
+	if src == nil {
+		return nil, nil
+	}
+	uncompressed, err := c.Compressor.Decompress(src)
+	if err != nil {
+		return nil, err
+	}
+	return c.Codec.DecodeValue(m, oid, format, uncompressed)
+}
+
+// StringMapHstoreCodec is pgxtypefaster.HstoreCodec with a binary encode plan for
+// map[string]string, so callers that never have NULL values do not need to convert to Hstore.
+// All other values and formats use pgxtypefaster.HstoreCodec.
+type StringMapHstoreCodec struct {
+	pgxtypefaster.HstoreCodec
+}
+
+// PlanEncode implements pgtype.Codec.
+func (c StringMapHstoreCodec) PlanEncode(m *pgtype.Map, oid uint32, format int16, value any) pgtype.EncodePlan {
+	if _, ok := value.(map[string]string); ok && format == pgtype.BinaryFormatCode {
+		return encodePlanStringMapBinary{}
+	}
+	return c.HstoreCodec.PlanEncode(m, oid, format, value)
+}
+
+type encodePlanStringMapBinary struct{}
+
+func (encodePlanStringMapBinary) Encode(value any, buf []byte) (newBuf []byte, err error) {
+	m := value.(map[string]string)
+	if m == nil {
+		return nil, nil
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(m)))
+	for k, v := range m {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(k)))
+		buf = append(buf, k...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		buf = append(buf, v...)
+	}
+	return buf, nil
+}
+
+// TextDecoder is implemented by types that decode themselves from the Postgres text format. It
+// is the equivalent of pgtype.TextDecoder from pgx v4, which pgx v5 removed, for code that
+// dispatches on that interface. A nil src is NULL.
+type TextDecoder interface {
+	DecodeText(src []byte) error
+}
+
+// TextDecodableHstore is a pgxtypefaster.Hstore that implements TextDecoder. The embedded Hstore
+// also implements sql.Scanner and driver.Valuer.
+type TextDecodableHstore struct {
+	pgxtypefaster.Hstore
+}
+
+// DecodeText implements TextDecoder.
+func (h *TextDecodableHstore) DecodeText(src []byte) error {
+	if src == nil {
+		h.Hstore = nil
+		return nil
+	}
+	err := h.Hstore.Scan(string(src))
+	if err != nil {
+		return err
+	}
+	// pgxtypefaster parses the empty string as a nil Hstore, but only a nil src is NULL
+	if h.Hstore == nil {
+		h.Hstore = pgxtypefaster.Hstore{}
+	}
+	return nil
+}
+
+// PrintableHstore is a pgxtypefaster.Hstore that implements fmt.Stringer. pgxtypefaster.Hstore does
+// not, so fmt prints it as a map of pgtype.Text structs in an unspecified order.
+type PrintableHstore struct {
+	pgxtypefaster.Hstore
+}
+
+// String returns the pairs sorted by key in the form "k1"=>"v1", "k2"=>NULL, with keys and values
+// quoted using Go syntax. A NULL hstore is NULL.
+func (h PrintableHstore) String() string {
+	if h.Hstore == nil {
+		return "NULL"
+	}
+	keys := make([]string, 0, len(h.Hstore))
+	for k := range h.Hstore {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := &strings.Builder{}
+	for i, k := range keys {
+		if i != 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString(strconv.Quote(k))
+		out.WriteString("=>")
+		if v := h.Hstore[k]; v.Valid {
+			out.WriteString(strconv.Quote(v.String))
+		} else {
+			out.WriteString("NULL")
+		}
+	}
+	return out.String()
+}
+
+// BinaryDecoder is implemented by types that decode themselves from the Postgres binary format.
+// It is the equivalent of pgtype.BinaryDecoder from pgx v4. pgx v5 removed it: rows.Scan always
+// plans the scan with the connection's pgtype.Map. A nil src is NULL.
+type BinaryDecoder interface {
+	DecodeBinary(src []byte) error
+}
+
+// hstoreBinaryScanPlan decodes the binary format into a *pgtype.Hstore. Scan plans from
+// pgtype.HstoreCodec do not depend on the value, so one plan can be reused.
+var hstoreBinaryScanPlan = pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &pgtype.Hstore{})
+
+// DirectBinaryHstore is a pgtype.Hstore that implements BinaryDecoder with the pgtype.HstoreCodec
+// binary scan plan, so callers can decode raw values without the pgtype.Map.
+type DirectBinaryHstore struct {
+	pgtype.Hstore
+}
+
+// DecodeBinary implements BinaryDecoder.
+func (h *DirectBinaryHstore) DecodeBinary(src []byte) error {
+	return hstoreBinaryScanPlan.Scan(src, &h.Hstore)
+}
+
+// TextOnlyHstoreCodec is pgxtypefaster.HstoreCodec, but prefers the text format, for connections
+// through proxies that do not support the binary format.
+type TextOnlyHstoreCodec struct {
+	pgxtypefaster.HstoreCodec
+}
+
+// PreferredFormat implements pgtype.Codec.
+func (TextOnlyHstoreCodec) PreferredFormat() int16 {
+	return pgtype.TextFormatCode
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/evanj/pgxtypefaster"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// fasterHstores returns roundTripHstores converted to pgxtypefaster.Hstore.
+func fasterHstores() []pgxtypefaster.Hstore {
+	out := make([]pgxtypefaster.Hstore, len(roundTripHstores))
+	for i, h := range roundTripHstores {
+		out[i] = pgxtypefaster.PGXToFasterHstore(h)
+	}
+	return out
+}
+
+// encodeWithCodec encodes value with codec in the binary format.
+func encodeWithCodec(tb testing.TB, codec pgtype.Codec, value any) []byte {
+	plan := codec.PlanEncode(nil, 0, pgtype.BinaryFormatCode, value)
+	if plan == nil {
+		tb.Fatalf("%T: no binary encode plan for %T", codec, value)
+	}
+	encoded, err := plan.Encode(value, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return encoded
+}
+
+func TestCompressedHstoreCodec(t *testing.T) {
+	codec := CompressedHstoreCodec{Compressor: GzipCompressor{Level: gzip.DefaultCompression}}
+	var scanned pgxtypefaster.Hstore
+	scanPlan := codec.PlanScan(nil, 0, pgtype.BinaryFormatCode, &scanned)
+
+	for i, h := range fasterHstores() {
+		encoded := encodeWithCodec(t, codec, h)
+		err := scanPlan.Scan(encoded, &scanned)
+		if err != nil {
+			t.Fatalf("%d: Scan(%#v) err=%s", i, encoded, err)
+		}
+		if !reflect.DeepEqual(h, scanned) {
+			t.Errorf("%d: Scan(%#v)=%#v; expected %#v", i, encoded, scanned, h)
+		}
+
+		decoded, err := codec.DecodeValue(nil, 0, pgtype.BinaryFormatCode, encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(h, decoded) {
+			t.Errorf("%d: DecodeValue(%#v)=%#v; expected %#v", i, encoded, decoded, h)
+		}
+	}
+
+	// NULL
+	encoded := encodeWithCodec(t, codec, pgxtypefaster.Hstore(nil))
+	if encoded != nil {
+		t.Errorf("NULL hstore must encode to nil; got %#v", encoded)
+	}
+	err := scanPlan.Scan(nil, &scanned)
+	if !(err == nil && scanned == nil) {
+		t.Errorf("Scan(nil)=%#v, %#v; expected nil, nil", scanned, err)
+	}
+
+	// the text format is not supported
+	if codec.PlanScan(nil, 0, pgtype.TextFormatCode, &scanned) != nil {
+		t.Error("PlanScan must not support the text format")
+	}
+
+	// not compressed
+	err = scanPlan.Scan([]byte("\x00\x00\x00\x00"), &scanned)
+	if err == nil {
+		t.Errorf("Scan of uncompressed data must fail; got %#v", scanned)
+	}
+}
+
+func BenchmarkCompressedHstoreCodec(b *testing.B) {
+	// compression only makes sense for large values
+	const numPairs = 100
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	hstores := make([]pgxtypefaster.Hstore, 100)
+	for i := range hstores {
+		hstores[i] = pgxtypefaster.PGXToFasterHstore(genHstore(rng, numPairs))
+	}
+
+	codecs := []struct {
+		label string
+		codec pgtype.Codec
+	}{
+		{"uncompressed", pgxtypefaster.HstoreCodec{}},
+		{"gzip_default", CompressedHstoreCodec{Compressor: GzipCompressor{Level: gzip.DefaultCompression}}},
+		{"gzip_best_speed", CompressedHstoreCodec{Compressor: GzipCompressor{Level: gzip.BestSpeed}}},
+	}
+	for _, codec := range codecs {
+		encoded := make([][]byte, len(hstores))
+		totalBytes := 0
+		for i, h := range hstores {
+			encoded[i] = encodeWithCodec(b, codec.codec, h)
+			totalBytes += len(encoded[i])
+		}
+		avgBytes := float64(totalBytes) / float64(len(hstores))
+
+		var scanned pgxtypefaster.Hstore
+		scanPlan := codec.codec.PlanScan(nil, 0, pgtype.BinaryFormatCode, &scanned)
+		encodePlan := codec.codec.PlanEncode(nil, 0, pgtype.BinaryFormatCode, hstores[0])
+
+		b.Run(codec.label+"/encode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := encodePlan.Encode(hstores[i%len(hstores)], nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(avgBytes, "bytes/value")
+		})
+		b.Run(codec.label+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := scanPlan.Scan(encoded[i%len(encoded)], &scanned)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(avgBytes, "bytes/value")
+		})
+	}
+}
+
+// TestFasterHstoreSprint checks that fmt prints readable key/value pairs for
+// pgxtypefaster.Hstore wrapped in PrintableHstore.
+func TestFasterHstoreSprint(t *testing.T) {
+	tests := []struct {
+		h        pgxtypefaster.Hstore
+		expected string
+	}{
+		{nil, "NULL"},
+		{pgxtypefaster.Hstore{}, ""},
+		{pgxtypefaster.Hstore{
+			"k2": pgtype.Text{},
+			"k1": pgxtypefaster.NewText("v1"),
+			"":   pgxtypefaster.NewText("quote\"=>,"),
+		}, `""=>"quote\"=>,", "k1"=>"v1", "k2"=>NULL`},
+	}
+	for _, test := range tests {
+		out := fmt.Sprint(PrintableHstore{test.h})
+		if out != test.expected {
+			t.Errorf("fmt.Sprint(PrintableHstore{%#v})=%#v; expected %#v", test.h, out, test.expected)
+		}
+		out = fmt.Sprintf("%v", PrintableHstore{test.h})
+		if out != test.expected {
+			t.Errorf("fmt.Sprintf(%%v, PrintableHstore{%#v})=%#v; expected %#v", test.h, out, test.expected)
+		}
+	}
+}
+
+func TestStringMapHstoreCodec(t *testing.T) {
+	codec := StringMapHstoreCodec{}
+	var scanned pgxtypefaster.Hstore
+	scanPlan := codec.PlanScan(nil, 0, pgtype.BinaryFormatCode, &scanned)
+
+	stringMaps := []map[string]string{
+		{},
+		{"": ""},
+		{"k": "v"},
+		{"k1": "v1", "k2": "", "a\x00b": "unicode 😅"},
+	}
+	for i, m := range stringMaps {
+		encoded := encodeWithCodec(t, codec, m)
+		err := scanPlan.Scan(encoded, &scanned)
+		if err != nil {
+			t.Fatalf("%d: Scan(%#v) err=%s", i, encoded, err)
+		}
+		expected := make(pgxtypefaster.Hstore, len(m))
+		for k, v := range m {
+			expected[k] = pgxtypefaster.NewText(v)
+		}
+		if !reflect.DeepEqual(expected, scanned) {
+			t.Errorf("%d: Scan(%#v)=%#v; expected %#v", i, encoded, scanned, expected)
+		}
+	}
+
+	// NULL
+	encoded := encodeWithCodec(t, codec, map[string]string(nil))
+	if encoded != nil {
+		t.Errorf("nil map must encode to nil; got %#v", encoded)
+	}
+
+	// other types use pgxtypefaster.HstoreCodec
+	for i, h := range fasterHstores() {
+		encoded := encodeWithCodec(t, codec, h)
+		err := scanPlan.Scan(encoded, &scanned)
+		if err != nil {
+			t.Fatalf("%d: Scan(%#v) err=%s", i, encoded, err)
+		}
+		if !reflect.DeepEqual(h, scanned) {
+			t.Errorf("%d: Scan(%#v)=%#v; expected %#v", i, encoded, scanned, h)
+		}
+	}
+	if codec.PlanEncode(nil, 0, pgtype.TextFormatCode, map[string]string{}) != nil {
+		t.Error("PlanEncode must not support map[string]string with the text format")
+	}
+}
+
+func BenchmarkStringMapHstoreCodec(b *testing.B) {
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	stringMaps := make([]map[string]string, 1000)
+	for i := range stringMaps {
+		numPairs := 1 + rng.Intn(maxKVPairsPerRow-1)
+		m := make(map[string]string, numPairs)
+		for len(m) < numPairs {
+			m[genString(rng)] = genString(rng)
+		}
+		stringMaps[i] = m
+	}
+
+	codec := StringMapHstoreCodec{}
+	b.Run("map_string_string", func(b *testing.B) {
+		b.ReportAllocs()
+		encodePlan := codec.PlanEncode(nil, 0, pgtype.BinaryFormatCode, stringMaps[0])
+		for i := 0; i < b.N; i++ {
+			_, err := encodePlan.Encode(stringMaps[i%len(stringMaps)], nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("convert_to_hstore", func(b *testing.B) {
+		b.ReportAllocs()
+		encodePlan := codec.PlanEncode(nil, 0, pgtype.BinaryFormatCode, pgxtypefaster.Hstore{})
+		for i := 0; i < b.N; i++ {
+			m := stringMaps[i%len(stringMaps)]
+			h := make(pgxtypefaster.Hstore, len(m))
+			for k, v := range m {
+				h[k] = pgxtypefaster.NewText(v)
+			}
+			_, err := encodePlan.Encode(h, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTextDecodableHstore(t *testing.T) {
+	var h TextDecodableHstore
+	var decoder TextDecoder = &h
+	for i, expected := range fasterHstores() {
+		// encode into a non-nil buffer: the empty hstore encodes as zero bytes, and nil is NULL
+		plan := pgxtypefaster.HstoreCodec{}.PlanEncode(nil, 0, pgtype.TextFormatCode, expected)
+		encoded, err := plan.Encode(expected, []byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = decoder.DecodeText(encoded)
+		if err != nil {
+			t.Fatalf("%d: DecodeText(%#v) err=%s", i, string(encoded), err)
+		}
+		if !reflect.DeepEqual(h.Hstore, expected) {
+			t.Errorf("%d: DecodeText(%#v)=%#v; expected %#v", i, string(encoded), h.Hstore, expected)
+		}
+	}
+
+	err := decoder.DecodeText(nil)
+	if !(err == nil && h.Hstore == nil) {
+		t.Errorf("DecodeText(nil)=%#v, %v; expected nil, nil", h.Hstore, err)
+	}
+
+	err = decoder.DecodeText([]byte(`"unterminated`))
+	if err == nil {
+		t.Errorf("DecodeText of invalid text must fail; got %#v", h.Hstore)
+	}
+
+	// the embedded Hstore implements sql.Scanner
+	err = h.Scan(`"k"=>"v"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pgxtypefaster.Hstore{"k": pgxtypefaster.NewText("v")}
+	if !reflect.DeepEqual(h.Hstore, expected) {
+		t.Errorf("Scan=%#v; expected %#v", h.Hstore, expected)
+	}
+}
+
+func TestDirectBinaryHstore(t *testing.T) {
+	var h DirectBinaryHstore
+	var decoder BinaryDecoder = &h
+	for i, expected := range roundTripHstores {
+		encoded := encodeHstoreBinary(t, expected)
+		err := decoder.DecodeBinary(encoded)
+		if err != nil {
+			t.Fatalf("%d: DecodeBinary(%#v) err=%s", i, encoded, err)
+		}
+		if !reflect.DeepEqual(h.Hstore, expected) {
+			t.Errorf("%d: DecodeBinary(%#v)=%#v; expected %#v", i, encoded, h.Hstore, expected)
+		}
+	}
+
+	err := decoder.DecodeBinary(nil)
+	if !(err == nil && h.Hstore == nil) {
+		t.Errorf("DecodeBinary(nil)=%#v, %v; expected nil, nil", h.Hstore, err)
+	}
+	err = decoder.DecodeBinary([]byte{0, 0, 0, 1})
+	if err == nil {
+		t.Errorf("DecodeBinary of a truncated value must fail; got %#v", h.Hstore)
+	}
+}
+
+func TestTextOnlyHstoreCodec(t *testing.T) {
+	if (TextOnlyHstoreCodec{}).PreferredFormat() != pgtype.TextFormatCode {
+		t.Error("TextOnlyHstoreCodec must prefer the text format")
+	}
+
+	cfg := newHstoreConfig(t)
+	conn := connect(t, cfg)
+	ctx := context.Background()
+	hstoreOID, err := queryHstoreOID(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerHstoreTypeMap(hstoreOID, conn.TypeMap(), TextOnlyHstoreCodec{})
+
+	for _, h := range fasterHstores() {
+		rows, err := conn.Query(ctx, "SELECT $1::hstore", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out pgxtypefaster.Hstore
+		for rows.Next() {
+			format := rows.FieldDescriptions()[0].Format
+			if format != pgtype.TextFormatCode {
+				t.Errorf("query returned format %d; expected text", format)
+			}
+			err = rows.Scan(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rows.Err() != nil {
+			t.Fatal(rows.Err())
+		}
+		// pgxtypefaster parses the empty text hstore as nil
+		if len(h) == 0 && out == nil {
+			continue
+		}
+		if !reflect.DeepEqual(out, h) {
+			t.Errorf("text round trip=%#v; expected %#v", out, h)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+)
+
+// sortedKeys returns the keys of h in sorted order, so conversions produce deterministic output.
+func sortedKeys(h pgtype.Hstore) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// emptyKeyNullCSV is the CSV encoding of an hstore with only the empty key with a NULL value, which
+// would otherwise be the empty string, like the empty hstore.
+const emptyKeyNullCSV = ","
+
+// HstoreToCSV returns h in the form "key1=value1,key2=value2", sorted by key. Keys and values are
+// URL query encoded, so they can contain commas and equals signs. A NULL value is written as the
+// key without "=". The empty hstore is the empty string, so an hstore with only the empty key and a
+// NULL value is written as a single comma.
+func HstoreToCSV(h pgtype.Hstore) string {
+	if v, ok := h[""]; ok && v == nil && len(h) == 1 {
+		return emptyKeyNullCSV
+	}
+	out := &strings.Builder{}
+	for i, k := range sortedKeys(h) {
+		if i != 0 {
+			out.WriteByte(',')
+		}
+		out.WriteString(url.QueryEscape(k))
+		if v := h[k]; v != nil {
+			out.WriteByte('=')
+			out.WriteString(url.QueryEscape(*v))
+		}
+	}
+	return out.String()
+}
+
+// HstoreFromCSV parses the output of HstoreToCSV. The empty string returns an empty hstore.
+func HstoreFromCSV(s string) (pgtype.Hstore, error) {
+	h := pgtype.Hstore{}
+	if s == "" {
+		return h, nil
+	}
+	if s == emptyKeyNullCSV {
+		h[""] = nil
+		return h, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		encodedKey, encodedValue, hasValue := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("hstore csv: invalid key %#v: %w", encodedKey, err)
+		}
+		if _, exists := h[key]; exists {
+			return nil, fmt.Errorf("hstore csv: duplicate key %#v", key)
+		}
+		if !hasValue {
+			h[key] = nil
+			continue
+		}
+		value, err := url.QueryUnescape(encodedValue)
+		if err != nil {
+			return nil, fmt.Errorf("hstore csv: invalid value %#v: %w", encodedValue, err)
+		}
+		h[key] = &value
+	}
+	return h, nil
+}
+
+// HstoreToFlatSlice returns h as alternating keys and values: []string{"k1", "v1", "k2", "v2"},
+// sorted by key. A slice of strings cannot represent NULL, so NULL values are the empty string.
+func HstoreToFlatSlice(h pgtype.Hstore) []string {
+	out := make([]string, 0, 2*len(h))
+	for _, k := range sortedKeys(h) {
+		value := ""
+		if v := h[k]; v != nil {
+			value = *v
+		}
+		out = append(out, k, value)
+	}
+	return out
+}
+
+// HstoreFromFlatSlice returns an hstore from alternating keys and values. It returns an error if s
+// has an odd length or contains a duplicate key.
+func HstoreFromFlatSlice(s []string) (pgtype.Hstore, error) {
+	if len(s)%2 != 0 {
+		return nil, fmt.Errorf("hstore flat slice: odd length %d", len(s))
+	}
+	h := make(pgtype.Hstore, len(s)/2)
+	for i := 0; i < len(s); i += 2 {
+		key := s[i]
+		if _, exists := h[key]; exists {
+			return nil, fmt.Errorf("hstore flat slice: duplicate key %#v", key)
+		}
+		value := s[i+1]
+		h[key] = &value
+	}
+	return h, nil
+}
+
+// HstoreToProto returns h as a protobuf Struct. NULL values are protobuf null values. A NULL
+// hstore returns nil.
+func HstoreToProto(h pgtype.Hstore) *structpb.Struct {
+	if h == nil {
+		return nil
+	}
+	fields := make(map[string]*structpb.Value, len(h))
+	for k, v := range h {
+		if v == nil {
+			fields[k] = structpb.NewNullValue()
+		} else {
+			fields[k] = structpb.NewStringValue(*v)
+		}
+	}
+	return &structpb.Struct{Fields: fields}
+}
+
+// HstoreFromProto returns an hstore from a protobuf Struct. It returns an error if a value is not a
+// string or null, since hstore values can only be strings. A nil Struct returns a NULL hstore.
+func HstoreFromProto(s *structpb.Struct) (pgtype.Hstore, error) {
+	if s == nil {
+		return nil, nil
+	}
+	h := make(pgtype.Hstore, len(s.Fields))
+	for k, v := range s.Fields {
+		switch kind := v.GetKind().(type) {
+		case *structpb.Value_NullValue:
+			h[k] = nil
+		case *structpb.Value_StringValue:
+			value := kind.StringValue
+			h[k] = &value
+		default:
+			return nil, fmt.Errorf("hstore proto: key %#v has unsupported value type %T", k, kind)
+		}
+	}
+	return h, nil
+}
+
+// HstoreToURLValues returns h as url.Values with one value per key. A NULL value is a key with no
+// values. url.Values.Encode omits keys with no values, so NULL values are lost when encoded.
+func HstoreToURLValues(h pgtype.Hstore) url.Values {
+	values := make(url.Values, len(h))
+	for k, v := range h {
+		if v == nil {
+			values[k] = []string{}
+		} else {
+			values[k] = []string{*v}
+		}
+	}
+	return values
+}
+
+// HstoreFromURLValues returns an hstore from url.Values. If a key has multiple values, it uses the
+// first. A key with no values is NULL.
+func HstoreFromURLValues(values url.Values) pgtype.Hstore {
+	h := make(pgtype.Hstore, len(values))
+	for k, vs := range values {
+		if len(vs) == 0 {
+			h[k] = nil
+		} else {
+			value := vs[0]
+			h[k] = &value
+		}
+	}
+	return h
+}
+
+// HstoreAvroSchema is an Avro schema for an hstore: a map of nullable strings.
+const HstoreAvroSchema = `{"type": "map", "values": ["null", "string"]}`
+
+// HstoreToAvro returns h encoded in the Avro binary format with codec. The codec's schema must be a
+// map with values of type ["null", "string"], like HstoreAvroSchema. Parsing the schema is slow, so
+// callers should create the codec once with goavro.NewCodec and reuse it.
+func HstoreToAvro(h pgtype.Hstore, codec *goavro.Codec) ([]byte, error) {
+	native := make(map[string]any, len(h))
+	for k, v := range h {
+		if v == nil {
+			native[k] = nil
+		} else {
+			native[k] = goavro.Union("string", *v)
+		}
+	}
+	return codec.BinaryFromNative(nil, native)
+}
+
+// HstoreFromAvro decodes the output of HstoreToAvro with a codec for the same schema.
+func HstoreFromAvro(data []byte, codec *goavro.Codec) (pgtype.Hstore, error) {
+	native, remaining, err := codec.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) != 0 {
+		return nil, fmt.Errorf("hstore avro: %d unexpected trailing bytes", len(remaining))
+	}
+	nativeMap, ok := native.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("hstore avro: schema must be a map; decoded %T", native)
+	}
+
+	h := make(pgtype.Hstore, len(nativeMap))
+	for k, v := range nativeMap {
+		switch union := v.(type) {
+		case nil:
+			h[k] = nil
+		case map[string]any:
+			value, ok := union["string"].(string)
+			if !ok {
+				return nil, fmt.Errorf("hstore avro: key %#v has unsupported value %#v", k, union)
+			}
+			h[k] = &value
+		default:
+			return nil, fmt.Errorf("hstore avro: key %#v has unsupported value type %T", k, v)
+		}
+	}
+	return h, nil
+}
+
+// HstoreToYAML returns h as a YAML mapping with sorted keys. NULL values are YAML null.
+func HstoreToYAML(h pgtype.Hstore) ([]byte, error) {
+	// yaml.v3 encodes nil pointers as null
+	return yaml.Marshal(map[string]*string(h))
+}
+
+// HstoreFromYAML parses a YAML mapping of strings. Null values are NULL. Returns an error if a
+// value is not a scalar (e.g. a nested mapping or a sequence). An empty document is an empty
+// hstore.
+func HstoreFromYAML(data []byte) (pgtype.Hstore, error) {
+	var m map[string]*string
+	err := yaml.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("hstore yaml: %w", err)
+	}
+	if m == nil {
+		return pgtype.Hstore{}, nil
+	}
+	return pgtype.Hstore(m), nil
+}
+
+// HstoreToJSON returns h as a JSON object with sorted keys. NULL values are null, and a NULL
+// hstore (nil) is null, so HstoreFromJSON returns the same hstore. Invalid UTF-8 is replaced with
+// U+FFFD by encoding/json, so those strings do not round trip.
+func HstoreToJSON(h pgtype.Hstore) ([]byte, error) {
+	return json.Marshal(map[string]*string(h))
+}
+
+// jsonTypeName returns the JSON type of a value decoded by encoding/json into an any.
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// HstoreFromJSON parses a flat JSON object where every value is a string or null. Null values are
+// NULL. The JSON null is a NULL hstore (nil). Returns an error for any other value, including
+// nested objects, arrays, numbers, and booleans.
+func HstoreFromJSON(data []byte) (pgtype.Hstore, error) {
+	var decoded any
+	err := json.Unmarshal(data, &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("hstore json: %w", err)
+	}
+	if decoded == nil {
+		return nil, nil
+	}
+	object, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("hstore json: must be an object; found %s", jsonTypeName(decoded))
+	}
+
+	h := make(pgtype.Hstore, len(object))
+	for k, v := range object {
+		switch value := v.(type) {
+		case nil:
+			h[k] = nil
+		case string:
+			h[k] = &value
+		default:
+			return nil, fmt.Errorf("hstore json: key %#v has value of type %s; must be a string or null",
+				k, jsonTypeName(v))
+		}
+	}
+	return h, nil
+}
+
+// HstoreFromFlatJSON parses a flat JSON object like HstoreFromJSON, but also accepts numbers and
+// booleans, which are stored as their JSON text: true is "true", and 42 is "42". Numbers are not
+// reformatted, so 1.5e3 is "1.5e3". Returns an error for nested objects and arrays.
+func HstoreFromFlatJSON(data []byte) (pgtype.Hstore, error) {
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(data, &object)
+	if err != nil {
+		return nil, fmt.Errorf("hstore json: %w", err)
+	}
+	if object == nil {
+		return nil, nil
+	}
+
+	h := make(pgtype.Hstore, len(object))
+	for k, raw := range object {
+		// json.Unmarshal removes whitespace around raw, and it is valid JSON, so it is not empty
+		switch raw[0] {
+		case '"':
+			var value string
+			err = json.Unmarshal(raw, &value)
+			if err != nil {
+				return nil, fmt.Errorf("hstore json: key %#v: %w", k, err)
+			}
+			h[k] = &value
+		case 'n':
+			h[k] = nil
+		case '{':
+			return nil, fmt.Errorf("hstore json: key %#v has value of type object; must be a scalar", k)
+		case '[':
+			return nil, fmt.Errorf("hstore json: key %#v has value of type array; must be a scalar", k)
+		default:
+			// true, false, or a number
+			value := string(raw)
+			h[k] = &value
+		}
+	}
+	return h, nil
+}
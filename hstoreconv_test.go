@@ -0,0 +1,712 @@
+package main
+
+import (
+	mathrand "math/rand"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/linkedin/goavro/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// roundTripHstores are hstores that each conversion must preserve.
+var roundTripHstores = []pgtype.Hstore{
+	{},
+	{"": stringPtr("")},
+	{"k": stringPtr("v")},
+	{"k": nil},
+	{"k1": stringPtr("v1"), "k2": nil, "k3": stringPtr("")},
+	{"a,b": stringPtr("c=d"), "e=f": stringPtr("g,h")},
+	{"%20": stringPtr("+ &?"), "unicode": stringPtr("a😅b嘅")},
+	{"\"quoted\"": stringPtr("back\\slash"), "new\nline": stringPtr("\t")},
+}
+
+func TestHstoreCSVRoundTrip(t *testing.T) {
+	// the empty key with a NULL value must not be written like the empty hstore
+	hstores := append([]pgtype.Hstore{{"": nil}, {"": nil, "k": nil}}, roundTripHstores...)
+	for i, h := range hstores {
+		csv := HstoreToCSV(h)
+		out, err := HstoreFromCSV(csv)
+		if err != nil {
+			t.Errorf("%d: HstoreFromCSV(%#v) err=%s", i, csv, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: HstoreFromCSV(%#v)=%#v; expected %#v", i, csv, out, h)
+		}
+	}
+}
+
+func TestHstoreCSV(t *testing.T) {
+	h := pgtype.Hstore{"b": stringPtr("x,y"), "a": nil, "c": stringPtr("")}
+	const expected = "a,b=x%2Cy,c="
+	csv := HstoreToCSV(h)
+	if csv != expected {
+		t.Errorf("HstoreToCSV(%#v)=%#v; expected %#v", h, csv, expected)
+	}
+
+	for _, invalid := range []string{"a,a", "%zz=v", "k=%zz", "k,k=v", ",,"} {
+		h, err := HstoreFromCSV(invalid)
+		if err == nil {
+			t.Errorf("HstoreFromCSV(%#v)=%#v; expected error", invalid, h)
+		}
+	}
+}
+
+// genHstores returns n random hstores with up to maxKVPairsPerRow pairs.
+func genHstores(n int) []pgtype.Hstore {
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	hstores := make([]pgtype.Hstore, n)
+	for i := range hstores {
+		hstores[i] = genHstore(rng, 1+rng.Intn(maxKVPairsPerRow-1))
+	}
+	return hstores
+}
+
+func BenchmarkHstoreParseCSV(b *testing.B) {
+	hstores := genHstores(1000)
+	csvs := make([]string, len(hstores))
+	texts := make([]string, len(hstores))
+	for i, h := range hstores {
+		csvs[i] = HstoreToCSV(h)
+		text, err := h.Value()
+		if err != nil {
+			b.Fatal(err)
+		}
+		texts[i] = text.(string)
+	}
+
+	b.Run("csv", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreFromCSV(csvs[i%len(csvs)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// the Postgres text format parser
+	b.Run("text", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var h pgtype.Hstore
+			err := h.Scan(texts[i%len(texts)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestHstoreFlatSlice(t *testing.T) {
+	for i, h := range roundTripHstores {
+		flat := HstoreToFlatSlice(h)
+		if len(flat) != 2*len(h) {
+			t.Errorf("%d: HstoreToFlatSlice(%#v)=%#v; expected length %d", i, h, flat, 2*len(h))
+		}
+		out, err := HstoreFromFlatSlice(flat)
+		if err != nil {
+			t.Errorf("%d: HstoreFromFlatSlice(%#v) err=%s", i, flat, err)
+			continue
+		}
+
+		// NULL values are converted to the empty string
+		expected := pgtype.Hstore{}
+		for k, v := range h {
+			if v == nil {
+				v = stringPtr("")
+			}
+			expected[k] = v
+		}
+		if !reflect.DeepEqual(expected, out) {
+			t.Errorf("%d: HstoreFromFlatSlice(%#v)=%#v; expected %#v", i, flat, out, expected)
+		}
+	}
+
+	h := pgtype.Hstore{"b": stringPtr("2"), "a": stringPtr("1")}
+	expectedFlat := []string{"a", "1", "b", "2"}
+	flat := HstoreToFlatSlice(h)
+	if !reflect.DeepEqual(flat, expectedFlat) {
+		t.Errorf("HstoreToFlatSlice(%#v)=%#v; expected %#v", h, flat, expectedFlat)
+	}
+
+	for _, invalid := range [][]string{{"k"}, {"k", "v", "k2"}, {"k", "v1", "k", "v2"}} {
+		h, err := HstoreFromFlatSlice(invalid)
+		if err == nil {
+			t.Errorf("HstoreFromFlatSlice(%#v)=%#v; expected error", invalid, h)
+		}
+	}
+}
+
+func BenchmarkHstoreFlatSlice(b *testing.B) {
+	hstores := genHstores(1000)
+
+	b.Run("HstoreToFlatSlice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			flat := HstoreToFlatSlice(hstores[i%len(hstores)])
+			if len(flat) == 0 {
+				b.Fatal("unexpected empty slice")
+			}
+		}
+	})
+
+	// the baseline: iterate over the map directly without building a slice
+	b.Run("map_iteration", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			numBytes := 0
+			for k, v := range hstores[i%len(hstores)] {
+				numBytes += len(k) + len(*v)
+			}
+			if numBytes == 0 {
+				b.Fatal("unexpected empty hstore")
+			}
+		}
+	})
+
+	flats := make([][]string, len(hstores))
+	for i, h := range hstores {
+		flats[i] = HstoreToFlatSlice(h)
+	}
+	b.Run("HstoreFromFlatSlice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreFromFlatSlice(flats[i%len(flats)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestHstoreProto(t *testing.T) {
+	for i, h := range roundTripHstores {
+		s := HstoreToProto(h)
+		if len(s.Fields) != len(h) {
+			t.Errorf("%d: HstoreToProto(%#v)=%s; expected %d fields", i, h, s, len(h))
+		}
+		out, err := HstoreFromProto(s)
+		if err != nil {
+			t.Errorf("%d: HstoreFromProto(%s) err=%s", i, s, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: HstoreFromProto(%s)=%#v; expected %#v", i, s, out, h)
+		}
+	}
+
+	// NULL hstore
+	if s := HstoreToProto(nil); s != nil {
+		t.Errorf("HstoreToProto(nil)=%s; expected nil", s)
+	}
+	h, err := HstoreFromProto(nil)
+	if !(h == nil && err == nil) {
+		t.Errorf("HstoreFromProto(nil)=%#v, %#v; expected nil, nil", h, err)
+	}
+
+	for _, value := range []*structpb.Value{
+		structpb.NewNumberValue(42),
+		structpb.NewBoolValue(true),
+		structpb.NewStructValue(&structpb.Struct{}),
+		structpb.NewListValue(&structpb.ListValue{}),
+	} {
+		s := &structpb.Struct{Fields: map[string]*structpb.Value{"k": value}}
+		h, err := HstoreFromProto(s)
+		if err == nil {
+			t.Errorf("HstoreFromProto(%s)=%#v; expected error", s, h)
+		}
+	}
+}
+
+func BenchmarkHstoreProto(b *testing.B) {
+	hstores := genHstores(1000)
+	protos := make([][]byte, len(hstores))
+	protoBytes := 0
+	for i, h := range hstores {
+		var err error
+		protos[i], err = proto.Marshal(HstoreToProto(h))
+		if err != nil {
+			b.Fatal(err)
+		}
+		protoBytes += len(protos[i])
+	}
+	protoBytesPerValue := float64(protoBytes) / float64(len(hstores))
+
+	b.Run("proto/encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := proto.Marshal(HstoreToProto(hstores[i%len(hstores)]))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(protoBytesPerValue, "bytes/value")
+	})
+	b.Run("proto/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s := &structpb.Struct{}
+			err := proto.Unmarshal(protos[i%len(protos)], s)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_, err = HstoreFromProto(s)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(protoBytesPerValue, "bytes/value")
+	})
+
+	runBinaryHstoreBenchmarks(b, hstores)
+}
+
+// runBinaryHstoreBenchmarks runs sub-benchmarks that encode and decode hstores with the Postgres
+// binary format, to compare with other formats.
+func runBinaryHstoreBenchmarks(b *testing.B, hstores []pgtype.Hstore) {
+	binaries := make([][]byte, len(hstores))
+	totalBytes := 0
+	for i, h := range hstores {
+		binaries[i] = encodeHstoreBinary(b, h)
+		totalBytes += len(binaries[i])
+	}
+	bytesPerValue := float64(totalBytes) / float64(len(hstores))
+
+	encodePlan := pgtype.HstoreCodec{}.PlanEncode(nil, 0, pgtype.BinaryFormatCode, hstores[0])
+	b.Run("binary/encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := encodePlan.Encode(hstores[i%len(hstores)], nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(bytesPerValue, "bytes/value")
+	})
+	var h pgtype.Hstore
+	scanPlan := pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &h)
+	b.Run("binary/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			err := scanPlan.Scan(binaries[i%len(binaries)], &h)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(bytesPerValue, "bytes/value")
+	})
+}
+
+func TestHstoreURLValues(t *testing.T) {
+	for i, h := range roundTripHstores {
+		values := HstoreToURLValues(h)
+		out := HstoreFromURLValues(values)
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: HstoreFromURLValues(%#v)=%#v; expected %#v", i, values, out, h)
+		}
+	}
+
+	// multiple values: uses the first
+	values := url.Values{"k": {"first", "second"}, "null": {}}
+	expected := pgtype.Hstore{"k": stringPtr("first"), "null": nil}
+	out := HstoreFromURLValues(values)
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("HstoreFromURLValues(%#v)=%#v; expected %#v", values, out, expected)
+	}
+
+	// special characters survive encoding as a query string
+	h := pgtype.Hstore{"a&b": stringPtr("c=d"), "sp ace": stringPtr("100%"), "?": stringPtr("😅#")}
+	encoded := HstoreToURLValues(h).Encode()
+	const expectedEncoded = "%3F=%F0%9F%98%85%23&a%26b=c%3Dd&sp+ace=100%25"
+	if encoded != expectedEncoded {
+		t.Errorf("Encode()=%#v; expected %#v", encoded, expectedEncoded)
+	}
+	parsed, err := url.ParseQuery(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = HstoreFromURLValues(parsed)
+	if !reflect.DeepEqual(out, h) {
+		t.Errorf("HstoreFromURLValues(%#v)=%#v; expected %#v", parsed, out, h)
+	}
+}
+
+func BenchmarkHstoreURLValues(b *testing.B) {
+	hstores := genHstores(1000)
+	b.Run("HstoreToURLValues", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			HstoreToURLValues(hstores[i%len(hstores)])
+		}
+	})
+
+	values := make([]url.Values, len(hstores))
+	for i, h := range hstores {
+		values[i] = HstoreToURLValues(h)
+	}
+	b.Run("HstoreFromURLValues", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			HstoreFromURLValues(values[i%len(values)])
+		}
+	})
+}
+
+// newAvroCodec returns a goavro.Codec for schema.
+func newAvroCodec(tb testing.TB, schema string) *goavro.Codec {
+	tb.Helper()
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return codec
+}
+
+func TestHstoreAvro(t *testing.T) {
+	codec := newAvroCodec(t, HstoreAvroSchema)
+	for i, h := range roundTripHstores {
+		data, err := HstoreToAvro(h, codec)
+		if err != nil {
+			t.Fatalf("%d: HstoreToAvro(%#v) err=%s", i, h, err)
+		}
+		out, err := HstoreFromAvro(data, codec)
+		if err != nil {
+			t.Errorf("%d: HstoreFromAvro(%#v) err=%s", i, data, err)
+			continue
+		}
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: HstoreFromAvro(%#v)=%#v; expected %#v", i, data, out, h)
+		}
+	}
+
+	h := pgtype.Hstore{"k": stringPtr("v")}
+	for _, schema := range []string{
+		`{"type": "map", "values": "int"}`,
+		`{"type": "array", "items": "string"}`,
+	} {
+		data, err := HstoreToAvro(h, newAvroCodec(t, schema))
+		if err == nil {
+			t.Errorf("HstoreToAvro(%#v, %s)=%#v; expected error", h, schema, data)
+		}
+	}
+
+	// decoding with a different schema
+	data, err := HstoreToAvro(h, codec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := HstoreFromAvro(data, newAvroCodec(t, `{"type": "map", "values": "string"}`))
+	if err == nil {
+		t.Errorf("HstoreFromAvro with a different schema=%#v; expected error", out)
+	}
+}
+
+func BenchmarkHstoreAvro(b *testing.B) {
+	codec := newAvroCodec(b, HstoreAvroSchema)
+	hstores := genHstores(1000)
+	avros := make([][]byte, len(hstores))
+	avroBytes := 0
+	for i, h := range hstores {
+		var err error
+		avros[i], err = HstoreToAvro(h, codec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		avroBytes += len(avros[i])
+	}
+
+	b.Run("avro/encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreToAvro(hstores[i%len(hstores)], codec)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(avroBytes)/float64(len(hstores)), "bytes/value")
+	})
+	b.Run("avro/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreFromAvro(avros[i%len(avros)], codec)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(avroBytes)/float64(len(hstores)), "bytes/value")
+	})
+
+	runBinaryHstoreBenchmarks(b, hstores)
+}
+
+func TestHstoreYAML(t *testing.T) {
+	for i, h := range roundTripHstores {
+		data, err := HstoreToYAML(h)
+		if err != nil {
+			t.Fatalf("%d: HstoreToYAML(%#v) err=%s", i, h, err)
+		}
+		out, err := HstoreFromYAML(data)
+		if err != nil {
+			t.Errorf("%d: HstoreFromYAML(%#v) err=%s", i, string(data), err)
+			continue
+		}
+		if !reflect.DeepEqual(h, out) {
+			t.Errorf("%d: HstoreFromYAML(%#v)=%#v; expected %#v", i, string(data), out, h)
+		}
+	}
+
+	data, err := HstoreToYAML(pgtype.Hstore{"b": nil, "a": stringPtr("true")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expectedYAML = "a: \"true\"\nb: null\n"
+	if string(data) != expectedYAML {
+		t.Errorf("HstoreToYAML=%#v; expected %#v", string(data), expectedYAML)
+	}
+
+	parseTests := []struct {
+		input    string
+		expected pgtype.Hstore
+	}{
+		{"", pgtype.Hstore{}},
+		{"a: 1\nb: ~\nc:\nd: yes\n", pgtype.Hstore{
+			"a": stringPtr("1"), "b": nil, "c": nil, "d": stringPtr("yes"),
+		}},
+		{"{k: v}", pgtype.Hstore{"k": stringPtr("v")}},
+	}
+	for i, test := range parseTests {
+		out, err := HstoreFromYAML([]byte(test.input))
+		if err != nil {
+			t.Errorf("%d: HstoreFromYAML(%#v) err=%s", i, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, out) {
+			t.Errorf("%d: HstoreFromYAML(%#v)=%#v; expected %#v", i, test.input, out, test.expected)
+		}
+	}
+
+	for _, input := range []string{
+		"- a\n- b\n",
+		"k: {nested: v}\n",
+		"k: [v]\n",
+		"k: v\nk: w\n",
+		"k: 'unterminated\n",
+	} {
+		out, err := HstoreFromYAML([]byte(input))
+		if err == nil {
+			t.Errorf("HstoreFromYAML(%#v)=%#v; expected error", input, out)
+		}
+	}
+}
+
+// BenchmarkHstoreYAML compares YAML to JSON and the binary format.
+func BenchmarkHstoreYAML(b *testing.B) {
+	hstores := genHstores(1000)
+	yamls := make([][]byte, len(hstores))
+	jsons := make([][]byte, len(hstores))
+	yamlBytes := 0
+	jsonBytes := 0
+	for i, h := range hstores {
+		var err error
+		yamls[i], err = HstoreToYAML(h)
+		if err != nil {
+			b.Fatal(err)
+		}
+		yamlBytes += len(yamls[i])
+		jsons[i], err = HstoreToJSON(h)
+		if err != nil {
+			b.Fatal(err)
+		}
+		jsonBytes += len(jsons[i])
+	}
+
+	b.Run("yaml/encode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreToYAML(hstores[i%len(hstores)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(yamlBytes)/float64(len(hstores)), "bytes/value")
+	})
+	b.Run("yaml/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreFromYAML(yamls[i%len(yamls)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(yamlBytes)/float64(len(hstores)), "bytes/value")
+	})
+	b.Run("json/decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := HstoreFromJSON(jsons[i%len(jsons)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(jsonBytes)/float64(len(hstores)), "bytes/value")
+	})
+
+	runBinaryHstoreBenchmarks(b, hstores)
+}
+
+func TestHstoreFromJSON(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      pgtype.Hstore
+		errorContains string
+	}{
+		{`{"k":"v"}`, pgtype.Hstore{"k": stringPtr("v")}, ""},
+		{`{}`, pgtype.Hstore{}, ""},
+		{`null`, nil, ""},
+		{`{"k":null,"e":""}`, pgtype.Hstore{"k": nil, "e": stringPtr("")}, ""},
+		{`{"k":"v","k":"w"}`, pgtype.Hstore{"k": stringPtr("w")}, ""},
+		{`{"é":"😅","esc\"aped":"new\nline"}`,
+			pgtype.Hstore{"é": stringPtr("😅"), "esc\"aped": stringPtr("new\nline")}, ""},
+		{`{"k":{"nested":"obj"}}`, nil, `key "k" has value of type object`},
+		{`{"k":[1,2]}`, nil, `key "k" has value of type array`},
+		{`{"k":42}`, nil, `key "k" has value of type number`},
+		{`{"k":1.5e3}`, nil, `key "k" has value of type number`},
+		{`{"k":true}`, nil, `key "k" has value of type boolean`},
+		{`{"ok":"v","k":false}`, nil, `key "k" has value of type boolean`},
+		{`{"k":{}}`, nil, `key "k" has value of type object`},
+		{`["k","v"]`, nil, "must be an object; found array"},
+		{`"k"`, nil, "must be an object; found string"},
+		{`42`, nil, "must be an object; found number"},
+		{`{"k":"v"`, nil, "unexpected end of JSON input"},
+		{`{"k":"v"} {}`, nil, "invalid character"},
+		{``, nil, "unexpected end of JSON input"},
+	}
+	for i, test := range tests {
+		out, err := HstoreFromJSON([]byte(test.input))
+		if test.errorContains != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorContains) {
+				t.Errorf("%d: HstoreFromJSON(%#v)=%#v, %v; expected error containing %#v",
+					i, test.input, out, err, test.errorContains)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: HstoreFromJSON(%#v) err=%s", i, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%d: HstoreFromJSON(%#v)=%#v; expected %#v", i, test.input, out, test.expected)
+		}
+	}
+}
+
+func TestHstoreFromFlatJSON(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      pgtype.Hstore
+		errorContains string
+	}{
+		{`{"k":"v"}`, pgtype.Hstore{"k": stringPtr("v")}, ""},
+		{`null`, nil, ""},
+		{`{}`, pgtype.Hstore{}, ""},
+		{`{"s":"str", "i":42, "neg":-7, "f":1.5e3, "t":true, "false":false, "null":null}`, pgtype.Hstore{
+			"s": stringPtr("str"), "i": stringPtr("42"), "neg": stringPtr("-7"), "f": stringPtr("1.5e3"),
+			"t": stringPtr("true"), "false": stringPtr("false"), "null": nil,
+		}, ""},
+		// numbers are not rounded to float64
+		{`{"big":12345678901234567890}`, pgtype.Hstore{"big": stringPtr("12345678901234567890")}, ""},
+		{`{ "spaces" : 1 , "escaped":"é\"" }`,
+			pgtype.Hstore{"spaces": stringPtr("1"), "escaped": stringPtr("é\"")}, ""},
+		{`{"k":{"nested":"obj"}}`, nil, `key "k" has value of type object`},
+		{`{"k":[1,2]}`, nil, `key "k" has value of type array`},
+		{`["k","v"]`, nil, "cannot unmarshal array"},
+		{`42`, nil, "cannot unmarshal number"},
+		{`{"k":tru}`, nil, "invalid character"},
+	}
+	for i, test := range tests {
+		out, err := HstoreFromFlatJSON([]byte(test.input))
+		if test.errorContains != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorContains) {
+				t.Errorf("%d: HstoreFromFlatJSON(%#v)=%#v, %v; expected error containing %#v",
+					i, test.input, out, err, test.errorContains)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: HstoreFromFlatJSON(%#v) err=%s", i, test.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%d: HstoreFromFlatJSON(%#v)=%#v; expected %#v", i, test.input, out, test.expected)
+		}
+	}
+
+	// accepts everything HstoreFromJSON accepts
+	for i, h := range roundTripHstores {
+		data, err := HstoreToJSON(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := HstoreFromFlatJSON(data)
+		if err != nil {
+			t.Errorf("%d: HstoreFromFlatJSON(%#v) err=%s", i, string(data), err)
+			continue
+		}
+		if !reflect.DeepEqual(out, h) {
+			t.Errorf("%d: HstoreFromFlatJSON(%#v)=%#v; expected %#v", i, string(data), out, h)
+		}
+	}
+}
+
+func TestHstoreRoundtripJSON(t *testing.T) {
+	roundTrip := func(h pgtype.Hstore) bool {
+		data, err := HstoreToJSON(h)
+		if err != nil {
+			t.Errorf("HstoreToJSON(%#v) err=%s", h, err)
+			return false
+		}
+		out, err := HstoreFromJSON(data)
+		if err != nil {
+			t.Errorf("HstoreFromJSON(%#v) err=%s", string(data), err)
+			return false
+		}
+		return reflect.DeepEqual(out, h)
+	}
+	err := quick.Check(roundTrip, &quick.Config{Rand: mathrand.New(mathrand.NewSource(rngSeed))})
+	if err != nil {
+		t.Error(err)
+	}
+	for i, h := range roundTripHstores {
+		if !roundTrip(h) {
+			t.Errorf("%d: %#v did not round trip", i, h)
+		}
+	}
+
+	edgeCases := []struct {
+		h        pgtype.Hstore
+		expected string
+	}{
+		{nil, `null`},
+		{pgtype.Hstore{}, `{}`},
+		// encoding/json escapes HTML characters
+		{pgtype.Hstore{"b": nil, "a": stringPtr("<&>")}, `{"a":"\u003c\u0026\u003e","b":null}`},
+	}
+	for _, test := range edgeCases {
+		data, err := HstoreToJSON(test.h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("HstoreToJSON(%#v)=%#v; expected %#v", test.h, string(data), test.expected)
+		}
+		if !roundTrip(test.h) {
+			t.Errorf("%#v did not round trip", test.h)
+		}
+	}
+}
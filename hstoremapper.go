@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// hstoreTag is the struct tag with the hstore key for a field.
+const hstoreTag = "hstore"
+
+// hstoreField is a struct field that is set from an hstore key.
+type hstoreField struct {
+	index     int
+	key       string
+	isPointer bool
+}
+
+// HstoreRowMapper maps hstores to structs of type T, using fields tagged with `hstore:"key"`.
+// Fields must be string or *string. A missing key or NULL value is the empty string or nil. Fields
+// without the tag are not changed. The reflection is done once by NewHstoreRowMapper.
+type HstoreRowMapper[T any] struct {
+	fields []hstoreField
+}
+
+// NewHstoreRowMapper returns a mapper for T. It returns an error if T is not a struct, or if a
+// tagged field is not a string or *string.
+func NewHstoreRowMapper[T any]() (*HstoreRowMapper[T], error) {
+	structType := reflect.TypeOf((*T)(nil)).Elem()
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("HstoreRowMapper: %s is not a struct", structType)
+	}
+
+	var fields []hstoreField
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key, ok := field.Tag.Lookup(hstoreTag)
+		if !ok {
+			continue
+		}
+		if !field.IsExported() {
+			return nil, fmt.Errorf("HstoreRowMapper: %s.%s is not exported", structType, field.Name)
+		}
+		isPointer := false
+		switch field.Type {
+		case reflect.TypeOf(""):
+		case reflect.TypeOf((*string)(nil)):
+			isPointer = true
+		default:
+			return nil, fmt.Errorf("HstoreRowMapper: %s.%s has unsupported type %s; must be string or *string",
+				structType, field.Name, field.Type)
+		}
+		fields = append(fields, hstoreField{i, key, isPointer})
+	}
+	return &HstoreRowMapper[T]{fields}, nil
+}
+
+// Map returns a T with the tagged fields set from h.
+func (m *HstoreRowMapper[T]) Map(h pgtype.Hstore) T {
+	var out T
+	structValue := reflect.ValueOf(&out).Elem()
+	for _, field := range m.fields {
+		value := h[field.key]
+		if field.isPointer {
+			structValue.Field(field.index).Set(reflect.ValueOf(value))
+		} else if value != nil {
+			structValue.Field(field.index).SetString(*value)
+		}
+	}
+	return out
+}
+
+// Scan reads all rows, which must have a single hstore column, and returns a T for each row. It
+// closes rows.
+func (m *HstoreRowMapper[T]) Scan(rows pgx.Rows) ([]T, error) {
+	defer rows.Close()
+	var out []T
+	var h pgtype.Hstore
+	for rows.Next() {
+		err := rows.Scan(&h)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m.Map(h))
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return out, nil
+}
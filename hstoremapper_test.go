@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+type mappedUser struct {
+	Name     string  `hstore:"name"`
+	Email    *string `hstore:"email"`
+	Country  string  `hstore:"country"`
+	Untagged string
+}
+
+func TestHstoreRowMapper(t *testing.T) {
+	mapper, err := NewHstoreRowMapper[mappedUser]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		h        pgtype.Hstore
+		expected mappedUser
+	}{
+		{pgtype.Hstore{"name": stringPtr("n"), "email": stringPtr("e"), "country": stringPtr("c")},
+			mappedUser{"n", stringPtr("e"), "c", ""}},
+		// missing keys and NULL values
+		{pgtype.Hstore{"name": nil, "Untagged": stringPtr("x"), "other": stringPtr("y")},
+			mappedUser{}},
+		{pgtype.Hstore{"email": stringPtr("")}, mappedUser{Email: stringPtr("")}},
+		{nil, mappedUser{}},
+	}
+	for i, test := range tests {
+		out := mapper.Map(test.h)
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%d: Map(%#v)=%#v; expected %#v", i, test.h, out, test.expected)
+		}
+	}
+
+	_, err = NewHstoreRowMapper[string]()
+	if err == nil {
+		t.Error("NewHstoreRowMapper[string] must fail")
+	}
+	_, err = NewHstoreRowMapper[struct {
+		Count int `hstore:"count"`
+	}]()
+	if err == nil {
+		t.Error("NewHstoreRowMapper must fail for an int field")
+	}
+	_, err = NewHstoreRowMapper[struct {
+		name string `hstore:"name"`
+	}]()
+	if err == nil {
+		t.Error("NewHstoreRowMapper must fail for an unexported field")
+	}
+}
+
+func TestHstoreRowMapperScan(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	mapper, err := NewHstoreRowMapper[mappedUser]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := conn.Query(context.Background(), `SELECT kv FROM (VALUES
+		(1, 'name=>a, email=>NULL'::hstore), (2, 'country=>b'::hstore), (3, NULL)) v (id, kv)
+		ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := mapper.Scan(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []mappedUser{{Name: "a"}, {Country: "b"}, {}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("Scan()=%#v; expected %#v", out, expected)
+	}
+}
+
+func BenchmarkHstoreRowMapper(b *testing.B) {
+	hstores := genSharedKeyHstores(1000, maxKVPairsPerRow)
+	type mappedKeys struct {
+		Key0 string  `hstore:"key0"`
+		Key1 string  `hstore:"key1"`
+		Key2 *string `hstore:"key2"`
+		Key3 string  `hstore:"key3"`
+	}
+
+	mapper, err := NewHstoreRowMapper[mappedKeys]()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("reflect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			out := mapper.Map(hstores[i%len(hstores)])
+			if out.Key0 == "" {
+				b.Fatal("unexpected empty key0")
+			}
+		}
+	})
+
+	// the same mapping written by hand
+	getString := func(h pgtype.Hstore, key string) string {
+		if v := h[key]; v != nil {
+			return *v
+		}
+		return ""
+	}
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			h := hstores[i%len(hstores)]
+			out := mappedKeys{getString(h, "key0"), getString(h, "key1"), h["key2"], getString(h, "key3")}
+			if out.Key0 == "" {
+				b.Fatal("unexpected empty key0")
+			}
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// HstoreContainsAny returns true if h contains at least one of keys. This is the same as the
+// Postgres operator "kv ?| keys". It returns false if keys is empty.
+func HstoreContainsAny(h pgtype.Hstore, keys []string) bool {
+	for _, key := range keys {
+		if _, exists := h[key]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// HstorePatch returns a new hstore with the keys in patch applied to base. A NULL value in patch
+// deletes the key, so the result cannot contain NULL values from patch. base is not modified.
+func HstorePatch(base pgtype.Hstore, patch pgtype.Hstore) pgtype.Hstore {
+	out := make(pgtype.Hstore, len(base)+len(patch))
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(out, k)
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// HstoreWithDefault returns a new hstore with the keys in h, and the keys in defaults that h does
+// not contain. A key in h with a NULL value is not missing, so it keeps the NULL value. Neither
+// argument is modified.
+func HstoreWithDefault(h pgtype.Hstore, defaults pgtype.Hstore) pgtype.Hstore {
+	out := make(pgtype.Hstore, len(h)+len(defaults))
+	for k, v := range defaults {
+		out[k] = v
+	}
+	for k, v := range h {
+		out[k] = v
+	}
+	return out
+}
+
+// HstoreValidateOptions are the limits checked by HstoreValidate. Zero values are not checked.
+type HstoreValidateOptions struct {
+	MaxPairs    int
+	MaxKeyLen   int
+	MaxValueLen int
+	// If true, NULL values are invalid.
+	DisallowNullValues bool
+}
+
+// HstoreValidate returns an error if h does not satisfy opts.
+func HstoreValidate(h pgtype.Hstore, opts HstoreValidateOptions) error {
+	if opts.MaxPairs > 0 && len(h) > opts.MaxPairs {
+		return fmt.Errorf("hstore has %d pairs; max %d", len(h), opts.MaxPairs)
+	}
+	for k, v := range h {
+		if opts.MaxKeyLen > 0 && len(k) > opts.MaxKeyLen {
+			return fmt.Errorf("hstore key %#v has length %d; max %d", k, len(k), opts.MaxKeyLen)
+		}
+		if v == nil {
+			if opts.DisallowNullValues {
+				return fmt.Errorf("hstore key %#v has a NULL value", k)
+			}
+			continue
+		}
+		if opts.MaxValueLen > 0 && len(*v) > opts.MaxValueLen {
+			return fmt.Errorf("hstore key %#v has value length %d; max %d", k, len(*v), opts.MaxValueLen)
+		}
+	}
+	return nil
+}
+
+// HstoreValueSlice returns the value for key split by sep, for hstores that store multiple values
+// for a key as one separated string. It returns nil if key does not exist or its value is NULL,
+// and an empty slice if the value is the empty string.
+func HstoreValueSlice(h pgtype.Hstore, key string, sep string) []string {
+	v := h[key]
+	if v == nil {
+		return nil
+	}
+	if *v == "" {
+		return []string{}
+	}
+	return strings.Split(*v, sep)
+}
+
+// HstoreSetValueSlice returns a new hstore with key set to values joined by sep. Values must not
+// contain sep, and a slice containing only the empty string is stored the same as an empty slice,
+// so HstoreValueSlice only returns the same values when both are true. A nil slice sets the
+// value to NULL. h is not modified.
+func HstoreSetValueSlice(h pgtype.Hstore, key string, sep string, values []string) pgtype.Hstore {
+	out := make(pgtype.Hstore, len(h)+1)
+	for k, v := range h {
+		out[k] = v
+	}
+	if values == nil {
+		out[key] = nil
+	} else {
+		joined := strings.Join(values, sep)
+		out[key] = &joined
+	}
+	return out
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestHstoreContainsAny(t *testing.T) {
+	h := pgtype.Hstore{"a": stringPtr("1"), "b": nil}
+	tests := []struct {
+		h        pgtype.Hstore
+		keys     []string
+		expected bool
+	}{
+		{h, []string{"a", "b"}, true},
+		{h, []string{"x", "b"}, true},
+		{h, []string{"x", "y"}, false},
+		{h, []string{}, false},
+		{h, nil, false},
+		{nil, []string{"a"}, false},
+		{nil, nil, false},
+	}
+	for i, test := range tests {
+		out := HstoreContainsAny(test.h, test.keys)
+		if out != test.expected {
+			t.Errorf("%d: HstoreContainsAny(%#v, %#v)=%t; expected %t",
+				i, test.h, test.keys, out, test.expected)
+		}
+	}
+}
+
+func BenchmarkHstoreContainsAny(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	// search for a few keys that exist in the table
+	var keys []string
+	err := conn.QueryRow(ctx,
+		"SELECT array_agg(k) FROM (SELECT skeys(kv) AS k FROM benchmark LIMIT 3) s").Scan(&keys)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var expectedMatches int
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM benchmark WHERE kv ?| $1", keys).Scan(&expectedMatches)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Logf("%d rows contain any of keys=%#v", expectedMatches, keys)
+
+	var h pgtype.Hstore
+	b.Run("sql", timeIt(func() error {
+		rows, err := conn.Query(ctx, "SELECT kv FROM benchmark WHERE kv ?| $1", keys)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			err := rows.Scan(&h)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}))
+
+	// scans all rows: this is the cost of filtering on the client
+	b.Run("HstoreContainsAny", timeIt(func() error {
+		rows, err := conn.Query(ctx, "SELECT kv FROM benchmark")
+		if err != nil {
+			return err
+		}
+		matches := 0
+		for rows.Next() {
+			err := rows.Scan(&h)
+			if err != nil {
+				return err
+			}
+			if HstoreContainsAny(h, keys) {
+				matches++
+			}
+		}
+		if rows.Err() == nil && matches != expectedMatches {
+			return fmt.Errorf("expected %d matches; found %d", expectedMatches, matches)
+		}
+		return rows.Err()
+	}))
+}
+
+func TestHstorePatch(t *testing.T) {
+	base := pgtype.Hstore{"a": stringPtr("1"), "b": stringPtr("2"), "null": nil}
+	tests := []struct {
+		label    string
+		base     pgtype.Hstore
+		patch    pgtype.Hstore
+		expected pgtype.Hstore
+	}{
+		{"add", base, pgtype.Hstore{"c": stringPtr("3")},
+			pgtype.Hstore{"a": stringPtr("1"), "b": stringPtr("2"), "null": nil, "c": stringPtr("3")}},
+		{"update", base, pgtype.Hstore{"a": stringPtr("new"), "null": stringPtr("x")},
+			pgtype.Hstore{"a": stringPtr("new"), "b": stringPtr("2"), "null": stringPtr("x")}},
+		{"delete", base, pgtype.Hstore{"a": nil, "null": nil, "missing": nil},
+			pgtype.Hstore{"b": stringPtr("2")}},
+		{"empty_patch", base, pgtype.Hstore{}, base},
+		{"nil_patch", base, nil, base},
+		{"nil_base", nil, pgtype.Hstore{"a": stringPtr("1"), "b": nil},
+			pgtype.Hstore{"a": stringPtr("1")}},
+	}
+	for _, test := range tests {
+		out := HstorePatch(test.base, test.patch)
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%s: HstorePatch(%#v, %#v)=%#v; expected %#v",
+				test.label, test.base, test.patch, out, test.expected)
+		}
+	}
+
+	// base must not be modified
+	expectedBase := pgtype.Hstore{"a": stringPtr("1"), "b": stringPtr("2"), "null": nil}
+	if !reflect.DeepEqual(base, expectedBase) {
+		t.Errorf("HstorePatch modified base=%#v; expected %#v", base, expectedBase)
+	}
+}
+
+func TestHstoreWithDefault(t *testing.T) {
+	defaults := pgtype.Hstore{"a": stringPtr("default_a"), "b": stringPtr("default_b"), "null": nil}
+	tests := []struct {
+		label    string
+		h        pgtype.Hstore
+		defaults pgtype.Hstore
+		expected pgtype.Hstore
+	}{
+		{"empty_h", pgtype.Hstore{}, defaults, defaults},
+		{"nil_h", nil, defaults, defaults},
+		{"empty_defaults", pgtype.Hstore{"a": stringPtr("1")}, pgtype.Hstore{},
+			pgtype.Hstore{"a": stringPtr("1")}},
+		{"nil_defaults", pgtype.Hstore{"a": stringPtr("1")}, nil, pgtype.Hstore{"a": stringPtr("1")}},
+		{"overlapping", pgtype.Hstore{"a": stringPtr("1"), "c": stringPtr("3")}, defaults,
+			pgtype.Hstore{"a": stringPtr("1"), "b": stringPtr("default_b"), "c": stringPtr("3"), "null": nil}},
+		{"null_is_not_missing", pgtype.Hstore{"a": nil, "null": stringPtr("x")}, defaults,
+			pgtype.Hstore{"a": nil, "b": stringPtr("default_b"), "null": stringPtr("x")}},
+		{"both_nil", nil, nil, pgtype.Hstore{}},
+	}
+	for _, test := range tests {
+		out := HstoreWithDefault(test.h, test.defaults)
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("%s: HstoreWithDefault(%#v, %#v)=%#v; expected %#v",
+				test.label, test.h, test.defaults, out, test.expected)
+		}
+	}
+
+	// the arguments must not be modified
+	h := pgtype.Hstore{"a": stringPtr("1")}
+	HstoreWithDefault(h, defaults)
+	if !reflect.DeepEqual(h, pgtype.Hstore{"a": stringPtr("1")}) {
+		t.Errorf("HstoreWithDefault modified h=%#v", h)
+	}
+	expectedDefaults := pgtype.Hstore{"a": stringPtr("default_a"), "b": stringPtr("default_b"), "null": nil}
+	if !reflect.DeepEqual(defaults, expectedDefaults) {
+		t.Errorf("HstoreWithDefault modified defaults=%#v; expected %#v", defaults, expectedDefaults)
+	}
+}
+
+func TestHstoreValidate(t *testing.T) {
+	h := pgtype.Hstore{"a": stringPtr("1"), "bb": stringPtr("22"), "null": nil}
+	tests := []struct {
+		opts    HstoreValidateOptions
+		isValid bool
+	}{
+		{HstoreValidateOptions{}, true},
+		{HstoreValidateOptions{MaxPairs: 3, MaxKeyLen: 4, MaxValueLen: 2}, true},
+		{HstoreValidateOptions{MaxPairs: 2}, false},
+		{HstoreValidateOptions{MaxKeyLen: 3}, false},
+		{HstoreValidateOptions{MaxValueLen: 1}, false},
+		{HstoreValidateOptions{DisallowNullValues: true}, false},
+	}
+	for i, test := range tests {
+		err := HstoreValidate(h, test.opts)
+		if (err == nil) != test.isValid {
+			t.Errorf("%d: HstoreValidate(%#v, %#v)=%v; expected valid=%t", i, h, test.opts, err, test.isValid)
+		}
+	}
+
+	err := HstoreValidate(nil, HstoreValidateOptions{MaxPairs: 1, DisallowNullValues: true})
+	if err != nil {
+		t.Errorf("NULL hstore must be valid; err=%s", err)
+	}
+}
+
+// BenchmarkHstoreScanWithValidation measures the cost of calling HstoreValidate on each scanned row.
+// validate_% is the fraction of the validate=true time spent validating, computed from the ns/op of
+// the two sub-benchmarks, since timing each call would cost about as much as validating.
+func BenchmarkHstoreScanWithValidation(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	createBenchmarkTable(b, conn)
+	ctx := context.Background()
+
+	opts := HstoreValidateOptions{MaxPairs: maxKVPairsPerRow, MaxKeyLen: 64, MaxValueLen: 64,
+		DisallowNullValues: true}
+	var noValidateNanosPerOp float64
+	for _, validate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("validate=%t", validate), func(b *testing.B) {
+			var h pgtype.Hstore
+			for i := 0; i < b.N; i++ {
+				rows, err := conn.Query(ctx, "SELECT kv FROM benchmark")
+				if err != nil {
+					b.Fatal(err)
+				}
+				for rows.Next() {
+					err = rows.Scan(&h)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if validate {
+						err = HstoreValidate(h, opts)
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				if rows.Err() != nil {
+					b.Fatal(rows.Err())
+				}
+			}
+			nanosPerOp := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+			if !validate {
+				noValidateNanosPerOp = nanosPerOp
+			} else if noValidateNanosPerOp != 0 {
+				b.ReportMetric(100*(nanosPerOp-noValidateNanosPerOp)/nanosPerOp, "validate_%")
+			}
+		})
+	}
+}
+
+func TestHstoreValueSlice(t *testing.T) {
+	h := pgtype.Hstore{
+		"multi":  stringPtr("a,b,c"),
+		"single": stringPtr("a"),
+		"empty":  stringPtr(""),
+		"commas": stringPtr(",,"),
+		"null":   nil,
+	}
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{"multi", []string{"a", "b", "c"}},
+		{"single", []string{"a"}},
+		{"empty", []string{}},
+		{"commas", []string{"", "", ""}},
+		{"null", nil},
+		{"missing", nil},
+	}
+	for _, test := range tests {
+		out := HstoreValueSlice(h, test.key, ",")
+		if !reflect.DeepEqual(out, test.expected) {
+			t.Errorf("HstoreValueSlice(%#v, %#v)=%#v; expected %#v", h, test.key, out, test.expected)
+		}
+	}
+
+	// multi-character separators
+	out := HstoreValueSlice(pgtype.Hstore{"k": stringPtr("a::b")}, "k", "::")
+	if !reflect.DeepEqual(out, []string{"a", "b"}) {
+		t.Errorf("HstoreValueSlice with separator \"::\"=%#v", out)
+	}
+}
+
+func TestHstoreSetValueSlice(t *testing.T) {
+	base := pgtype.Hstore{"a": stringPtr("1"), "null": nil}
+	tests := []struct {
+		values   []string
+		expected *string
+	}{
+		{[]string{"x", "y", "z"}, stringPtr("x|y|z")},
+		{[]string{"x"}, stringPtr("x")},
+		{[]string{}, stringPtr("")},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		for _, key := range []string{"a", "null", "new"} {
+			out := HstoreSetValueSlice(base, key, "|", test.values)
+			expectedLen := len(base)
+			if _, exists := base[key]; !exists {
+				expectedLen++
+			}
+			if len(out) != expectedLen {
+				t.Errorf("HstoreSetValueSlice(%#v, %#v)=%#v; expected %d pairs",
+					key, test.values, out, expectedLen)
+			}
+			if !reflect.DeepEqual(out[key], test.expected) {
+				t.Errorf("HstoreSetValueSlice(%#v, %#v)[%#v]=%#v; expected %#v",
+					key, test.values, key, out[key], test.expected)
+			}
+
+			roundTrip := HstoreValueSlice(out, key, "|")
+			if !reflect.DeepEqual(roundTrip, test.values) {
+				t.Errorf("HstoreValueSlice(HstoreSetValueSlice(%#v))=%#v", test.values, roundTrip)
+			}
+		}
+	}
+
+	// base must not be modified
+	expectedBase := pgtype.Hstore{"a": stringPtr("1"), "null": nil}
+	if !reflect.DeepEqual(base, expectedBase) {
+		t.Errorf("HstoreSetValueSlice modified base=%#v; expected %#v", base, expectedBase)
+	}
+}
+
+func BenchmarkHstoreValueSlice(b *testing.B) {
+	values := []string{"red", "green", "blue", "cyan", "magenta", "yellow", "black", "white"}
+	h := pgtype.Hstore{"other": stringPtr("value")}
+	h = HstoreSetValueSlice(h, "colors", ",", values)
+
+	b.Run("HstoreValueSlice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			HstoreValueSlice(h, "colors", ",")
+		}
+	})
+	b.Run("HstoreSetValueSlice", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			HstoreSetValueSlice(h, "colors", ",", values)
+		}
+	})
+}
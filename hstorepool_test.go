@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// newHstorePoolConfig returns a pool config with at most maxConns connections, that registers
+// hstore on each connection.
+func newHstorePoolConfig(tb testing.TB, cfg *pgx.ConnConfig, maxConns int32) *pgxpool.Config {
+	poolConfig, err := pgxpool.ParseConfig(cfg.ConnString())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	poolConfig.MaxConns = maxConns
+	poolConfig.AfterConnect = registerHstore
+	return poolConfig
+}
+
+// newPool returns a pool using poolConfig. The pool is closed when the test completes.
+func newPool(tb testing.TB, poolConfig *pgxpool.Config) *pgxpool.Pool {
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(pool.Close)
+	return pool
+}
+
+// newHstorePool returns a pool with at most maxConns connections, that registers hstore on each
+// connection. The pool is closed when the test completes.
+func newHstorePool(tb testing.TB, cfg *pgx.ConnConfig, maxConns int32) *pgxpool.Pool {
+	return newPool(tb, newHstorePoolConfig(tb, cfg, maxConns))
+}
+
+func BenchmarkHstorePoolAcquisition(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	// a small query so the time to acquire a connection is a significant part of each operation
+	const query = "SELECT kv FROM benchmark LIMIT 100"
+
+	for _, poolSize := range []int32{1, 4, 16} {
+		pool := newHstorePool(b, cfg, poolSize)
+
+		b.Run(fmt.Sprintf("pool_size=%d", poolSize), func(b *testing.B) {
+			// use twice as many goroutines as connections so the pool is always fully utilized
+			goroutines := 2 * int(poolSize)
+			procs := runtime.GOMAXPROCS(0)
+			b.SetParallelism((goroutines + procs - 1) / procs)
+
+			var totalWaitNanos atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					conn, err := pool.Acquire(ctx)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					totalWaitNanos.Add(int64(time.Since(start)))
+
+					_, err = scanHstores(ctx, conn, query)
+					conn.Release()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(totalWaitNanos.Load())/float64(b.N), "connection_wait_ns/op")
+		})
+	}
+}
+
+// runConcurrently calls op b.N times in total, from the given number of goroutines. op is passed
+// the index of the goroutine calling it, from 0 to goroutines-1.
+func runConcurrently(b *testing.B, goroutines int, op func(goroutine int) error) {
+	var remaining atomic.Int64
+	remaining.Store(int64(b.N))
+	errs := make(chan error, goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func(goroutine int) {
+			for remaining.Add(-1) >= 0 {
+				err := op(goroutine)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < goroutines; i++ {
+		err := <-errs
+		if err != nil {
+			b.Error(err)
+		}
+	}
+}
+
+func BenchmarkHstorePoolSize(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	const query = "SELECT kv FROM benchmark LIMIT 1000"
+	const rowsPerOp = 1000
+
+	for _, poolSize := range []int32{4, 8, 16, 32} {
+		pool := newHstorePool(b, cfg, poolSize)
+
+		b.Run(fmt.Sprintf("pool_size=%d", poolSize), func(b *testing.B) {
+			// one goroutine per connection, so goroutines never wait for a connection
+			runConcurrently(b, int(poolSize), func(int) error {
+				scanned, err := scanHstores(ctx, pool, query)
+				if err == nil && scanned != rowsPerOp {
+					err = fmt.Errorf("expected %d rows; scanned %d", rowsPerOp, scanned)
+				}
+				return err
+			})
+			b.ReportMetric(float64(rowsPerOp*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// BenchmarkHstoreGoroutineScaling scans rows from an increasing number of goroutines, each with
+// its own connection. If rows/s scales linearly up to GOMAXPROCS, decoding is CPU-bound; if it
+// stops scaling earlier, the bottleneck is I/O or the server.
+func BenchmarkHstoreGoroutineScaling(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	const query = "SELECT kv FROM benchmark LIMIT 1000"
+	const rowsPerOp = 1000
+
+	for _, goroutines := range []int{1, 2, 4, 8, 16} {
+		conns := make([]*pgx.Conn, goroutines)
+		for i := range conns {
+			conns[i] = connectRegistered(b, cfg)
+		}
+
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			runConcurrently(b, goroutines, func(goroutine int) error {
+				scanned, err := scanHstores(ctx, conns[goroutine], query)
+				if err == nil && scanned != rowsPerOp {
+					err = fmt.Errorf("expected %d rows; scanned %d", rowsPerOp, scanned)
+				}
+				return err
+			})
+			b.ReportMetric(float64(rowsPerOp*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
+
+// BenchmarkHstorePoolMaxConnLifetime compares a pool that keeps its connections to one that
+// recycles them after 500ms. Each recycled connection must reconnect and register hstore again,
+// which shows up as latency spikes. It reports how often the pool connects, and the
+// median, 99th percentile, and maximum latency of each query.
+func BenchmarkHstorePoolMaxConnLifetime(b *testing.B) {
+	const poolSize = 4
+	const query = "SELECT kv FROM benchmark LIMIT 100"
+
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	lifetimes := []struct {
+		label    string
+		lifetime time.Duration
+	}{
+		{"lifetime=default", 0},
+		{"lifetime=500ms", 500 * time.Millisecond},
+	}
+	for _, l := range lifetimes {
+		poolConfig := newHstorePoolConfig(b, cfg, poolSize)
+		if l.lifetime != 0 {
+			poolConfig.MaxConnLifetime = l.lifetime
+			poolConfig.MaxConnLifetimeJitter = 0
+		}
+		var connects atomic.Int64
+		poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			connects.Add(1)
+			return registerHstore(ctx, conn)
+		}
+		pool := newPool(b, poolConfig)
+
+		b.Run(l.label, func(b *testing.B) {
+			startConnects := connects.Load()
+			// each goroutine appends to its own slice, so they do not need a lock
+			latencies := make([][]time.Duration, poolSize)
+			runConcurrently(b, poolSize, func(goroutine int) error {
+				start := time.Now()
+				_, err := scanHstores(ctx, pool, query)
+				latencies[goroutine] = append(latencies[goroutine], time.Since(start))
+				return err
+			})
+			newConnects := connects.Load() - startConnects
+			b.ReportMetric(float64(newConnects)/b.Elapsed().Seconds(), "connects/s")
+
+			var all []time.Duration
+			for _, goroutineLatencies := range latencies {
+				all = append(all, goroutineLatencies...)
+			}
+			if b.Failed() || len(all) == 0 {
+				return
+			}
+			sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+			b.ReportMetric(float64(all[len(all)/2]), "p50_ns")
+			b.ReportMetric(float64(all[len(all)*99/100]), "p99_ns")
+			b.ReportMetric(float64(all[len(all)-1]), "max_ns")
+		})
+	}
+}
+
+// BenchmarkHstoreScanAllQueryModesOnPool checks that every query mode returns the same results
+// through a pool, where modes that cache prepared statements or descriptions do so per
+// connection, then measures each mode.
+func BenchmarkHstoreScanAllQueryModesOnPool(b *testing.B) {
+	const poolSize = 4
+	const query = "SELECT kv FROM benchmark"
+
+	cfg := newHstoreConfig(b)
+	textConn := connect(b, cfg)
+	createBenchmarkTable(b, textConn)
+	ctx := context.Background()
+	expected := queryBenchmarkByID(b, textConn)
+
+	pool := newHstorePool(b, cfg, poolSize)
+	for _, mode := range allQueryExecModes {
+		// query more than once, so modes that cache statements use the cache
+		for i := 0; i < 2; i++ {
+			hstores := queryBenchmarkByID(b, pool, mode)
+			if !reflect.DeepEqual(hstores, expected) {
+				b.Fatalf("%s: query %d returned different hstores than the text format", mode, i)
+			}
+		}
+
+		b.Run(mode.String(), func(b *testing.B) {
+			runConcurrently(b, poolSize, func(int) error {
+				scanned, err := scanHstores(ctx, pool, query, mode)
+				if err == nil && scanned != numRows {
+					err = fmt.Errorf("expected %d rows; scanned %d", numRows, scanned)
+				}
+				return err
+			})
+			b.ReportMetric(float64(numRows*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+}
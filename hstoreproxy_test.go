@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// latencyConn simulates a proxy or load balancer between the client and Postgres, by sleeping
+// before each Read. pgx reads into a large buffer, so this adds latency to each batch of packets
+// received from the server.
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	time.Sleep(c.latency)
+	return c.Conn.Read(b)
+}
+
+// connectWithLatency returns a connection that adds latency to each read from Postgres, with hstore
+// registered. The connection is closed when the test completes.
+func connectWithLatency(tb testing.TB, cfg *pgx.ConnConfig, latency time.Duration) *pgx.Conn {
+	latencyCfg := cfg.Copy()
+	dial := latencyCfg.DialFunc
+	latencyCfg.DialFunc = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &latencyConn{conn, latency}, nil
+	}
+	return connectRegistered(tb, latencyCfg)
+}
+
+// BenchmarkHstoreScanViaProxy shows how network latency affects scan throughput for different
+// result sizes. Small results are dominated by the round trip; large results are dominated by
+// decoding.
+func BenchmarkHstoreScanViaProxy(b *testing.B) {
+	cfg := newHstoreConfig(b)
+	createBenchmarkTable(b, connect(b, cfg))
+	ctx := context.Background()
+
+	for _, latency := range []time.Duration{0, 100 * time.Microsecond, time.Millisecond} {
+		conn := connectWithLatency(b, cfg, latency)
+
+		for _, limit := range []int{1, 100, numRows} {
+			query := fmt.Sprintf("SELECT kv FROM benchmark LIMIT %d", limit)
+			b.Run(fmt.Sprintf("latency=%s/rows=%d", latency, limit), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					scanned, err := scanHstores(ctx, conn, query)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if scanned != limit {
+						b.Fatalf("expected %d rows; scanned %d", limit, scanned)
+					}
+				}
+				b.ReportMetric(float64(limit*b.N)/b.Elapsed().Seconds(), "rows/s")
+			})
+		}
+	}
+}
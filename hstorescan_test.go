@@ -0,0 +1,962 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanj/hacks/postgrestest"
+	"github.com/evanj/pgxtypefaster"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/tracelog"
+)
+
+// pgErrQueryCanceled is the SQLSTATE for a query canceled by a statement timeout or by the client.
+const pgErrQueryCanceled = "57014"
+
+func TestHstoreScanTimeout(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	createBenchmarkTable(t, conn)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "SET statement_timeout = '100ms'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pg_sleep makes every row slow, so the timeout fires part way through the scan
+	rows, err := conn.Query(ctx, "SELECT kv, pg_sleep(0.01) FROM benchmark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numScanned := 0
+	var h pgtype.Hstore
+	for rows.Next() {
+		err = rows.Scan(&h, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h) == 0 {
+			t.Fatalf("unexpected empty hstore: %#v", h)
+		}
+		numScanned++
+	}
+	if numScanned == 0 || numScanned >= numRows {
+		t.Errorf("expected the timeout to stop the scan part way; scanned %d rows", numScanned)
+	}
+
+	var pgErr *pgconn.PgError
+	if !errors.As(rows.Err(), &pgErr) || pgErr.Code != pgErrQueryCanceled {
+		t.Errorf("expected rows.Err() to be a query canceled error; got err=%#v", rows.Err())
+	}
+}
+
+// queryBenchmarkByID returns all hstores in the benchmark table by id. args are passed to Query,
+// so they can include a pgx.QueryExecMode.
+func queryBenchmarkByID(tb testing.TB, q querier, args ...any) map[int]pgtype.Hstore {
+	rows, err := q.Query(context.Background(), "SELECT id, kv FROM benchmark", args...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hstores := map[int]pgtype.Hstore{}
+	for rows.Next() {
+		var id int
+		var h pgtype.Hstore
+		err = rows.Scan(&id, &h)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		hstores[id] = h
+	}
+	if rows.Err() != nil {
+		tb.Fatal(rows.Err())
+	}
+	return hstores
+}
+
+func TestHstoreWithPreparedStatements(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	textConn := connect(t, cfg)
+	createBenchmarkTable(t, textConn)
+	ctx := context.Background()
+
+	// the expected values, decoded with the text format
+	expected := queryBenchmarkByID(t, textConn)
+
+	conn := connectRegistered(t, cfg)
+	const statementName = "select_kv_by_id"
+	_, err := conn.Prepare(ctx, statementName, "SELECT kv FROM benchmark WHERE id = $1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numExecutions = 1000
+	for i := 0; i < numExecutions; i++ {
+		// visit ids in a scattered order
+		id := 1 + (i*7919)%numRows
+		var h pgtype.Hstore
+		err = conn.QueryRow(ctx, statementName, id).Scan(&h)
+		if err != nil {
+			t.Fatalf("id=%d: err=%s", id, err)
+		}
+		if !reflect.DeepEqual(h, expected[id]) {
+			t.Errorf("id=%d: prepared statement returned %#v; expected %#v", id, h, expected[id])
+		}
+	}
+}
+
+func TestHstoreZeroValueScanTarget(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	ctx := context.Background()
+
+	conns := []struct {
+		label string
+		conn  *pgx.Conn
+	}{
+		{"text", connect(t, cfg)},
+		{"binary", connectRegistered(t, cfg)},
+	}
+	for _, c := range conns {
+		var h pgtype.Hstore
+		err := c.conn.QueryRow(ctx, `SELECT 'a=>1, b=>NULL'::hstore`).Scan(&h)
+		if err != nil {
+			t.Fatalf("%s: err=%s", c.label, err)
+		}
+		expected := pgtype.Hstore{"a": stringPtr("1"), "b": nil}
+		if !reflect.DeepEqual(h, expected) {
+			t.Errorf("%s: scanned zero value hstore=%#v; expected %#v", c.label, h, expected)
+		}
+
+		// scanning NULL into a populated hstore must set it to nil
+		err = c.conn.QueryRow(ctx, `SELECT NULL::hstore`).Scan(&h)
+		if err != nil {
+			t.Fatalf("%s: err=%s", c.label, err)
+		}
+		if h != nil {
+			t.Errorf("%s: scanning NULL must set hstore to nil; got %#v", c.label, h)
+		}
+	}
+}
+
+func TestHstoreSQLBinaryMatchesPGXBinary(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connect(t, cfg)
+	ctx := context.Background()
+	err := pgxtypefaster.RegisterHstore(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createBenchmarkTable(t, conn)
+	_, err = conn.Exec(ctx, `INSERT INTO benchmark (kv) VALUES
+		('a=>NULL, "quote\""=>"back\\slash", ""=>"", "unicode"=>"a😅b"'),
+		(''), (NULL)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT kv FROM benchmark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.FieldDescriptions()[0].Format != pgtype.BinaryFormatCode {
+		t.Fatalf("expected the binary format; got format=%d", rows.FieldDescriptions()[0].Format)
+	}
+	numRows := 0
+	for rows.Next() {
+		// database/sql passes the raw bytes as a string, or nil for NULL
+		raw := rows.RawValues()[0]
+		var src any
+		if raw != nil {
+			src = string(raw)
+		}
+		var fromSQL HstoreSQLBinary
+		err = fromSQL.Scan(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fromPGX pgxtypefaster.Hstore
+		err = rows.Scan(&fromPGX)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromSQL.Hstore, fromPGX) {
+			t.Errorf("raw=%#v: HstoreSQLBinary=%#v; pgx scan=%#v", raw, fromSQL.Hstore, fromPGX)
+		}
+		numRows++
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	if numRows == 0 {
+		t.Error("expected rows to compare")
+	}
+}
+
+func TestHstoreSendMatchesRawBinary(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connect(t, cfg)
+
+	// hstore_send is the function Postgres uses to create the binary format
+	var encoded []byte
+	err := conn.QueryRow(context.Background(), `SELECT hstore_send('"key"=>"value"'::hstore)`).Scan(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, keyValueBinary) {
+		t.Errorf("hstore_send returned %#v; expected %#v", encoded, keyValueBinary)
+	}
+}
+
+// TestHstoreScanAfterCancelledQuery cancels a query part way through the scan. Cancelling the
+// context passed to Query makes rows.Err() return context.Canceled, and pgx v5 closes the connection,
+// since it cannot know the protocol state. To keep the connection usable, the query must instead be
+// cancelled with a Postgres cancel request, which stops the query on the server.
+func TestHstoreScanAfterCancelledQuery(t *testing.T) {
+	const cancelAfterRows = 100
+
+	cfg := newHstoreConfig(t)
+	createBenchmarkTable(t, connect(t, cfg))
+
+	// scanUntilCancel scans the rows from a slow query, and calls cancel after cancelAfterRows. It
+	// returns rows.Err(). pg_sleep makes every row slow, so the cancel arrives before Postgres sends
+	// all rows.
+	scanUntilCancel := func(t *testing.T, ctx context.Context, conn *pgx.Conn, cancel func()) error {
+		t.Helper()
+		rows, err := conn.Query(ctx, "SELECT kv, pg_sleep(0.001) FROM benchmark")
+		if err != nil {
+			t.Fatal(err)
+		}
+		numScanned := 0
+		var h pgtype.Hstore
+		for rows.Next() {
+			err = rows.Scan(&h, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			numScanned++
+			if numScanned == cancelAfterRows {
+				cancel()
+			}
+		}
+		if numScanned < cancelAfterRows || numScanned >= numRows {
+			t.Errorf("expected the cancel to stop the scan part way; scanned %d rows", numScanned)
+		}
+		return rows.Err()
+	}
+
+	t.Run("context", func(t *testing.T) {
+		conn := connectRegistered(t, cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		err := scanUntilCancel(t, ctx, conn, cancel)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected rows.Err() to be context.Canceled; got err=%#v", err)
+		}
+		if !conn.IsClosed() {
+			t.Error("expected pgx to close the connection after cancelling the query context")
+		}
+	})
+
+	t.Run("cancel_request", func(t *testing.T) {
+		conn := connectRegistered(t, cfg)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelErr := make(chan error, 1)
+		go func() {
+			<-ctx.Done()
+			cancelErr <- conn.PgConn().CancelRequest(context.Background())
+			close(cancelErr)
+		}()
+		defer func() {
+			// wait for the goroutine, so it does not use conn after the test closes it
+			cancel()
+			for range cancelErr {
+			}
+		}()
+
+		// the query does not use ctx, so pgx does not close the connection
+		err := scanUntilCancel(t, context.Background(), conn, cancel)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != pgErrQueryCanceled {
+			t.Errorf("expected rows.Err() to be a query canceled error; got err=%#v", err)
+		}
+		err = <-cancelErr
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if conn.IsClosed() {
+			t.Fatal("expected the connection to be open after the cancelled query")
+		}
+		scanned, err := scanHstores(context.Background(), conn, "SELECT kv FROM benchmark")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scanned != numRows {
+			t.Errorf("expected %d rows after the cancelled query; scanned %d", numRows, scanned)
+		}
+	})
+}
+
+func TestFasterHstoreSinglePair(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	ctx := context.Background()
+
+	binaryConn := connect(t, cfg)
+	err := pgxtypefaster.RegisterHstore(ctx, binaryConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := []struct {
+		label  string
+		conn   *pgx.Conn
+		format int16
+	}{
+		{"text", connect(t, cfg), pgtype.TextFormatCode},
+		{"binary", binaryConn, pgtype.BinaryFormatCode},
+	}
+	for _, c := range conns {
+		rows, err := c.conn.Query(ctx, `SELECT '"k"=>"v"'::hstore`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h pgxtypefaster.Hstore
+		for rows.Next() {
+			if rows.FieldDescriptions()[0].Format != c.format {
+				t.Errorf("%s: unexpected format=%d", c.label, rows.FieldDescriptions()[0].Format)
+			}
+			err = rows.Scan(&h)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if rows.Err() != nil {
+			t.Fatal(rows.Err())
+		}
+
+		if len(h) != 1 || h["k"] != pgxtypefaster.NewText("v") {
+			t.Errorf("%s: expected exactly one pair k=>v; got %#v", c.label, h)
+		}
+	}
+}
+
+func TestHstoreNullByte(t *testing.T) {
+	nullByteHstores := []pgtype.Hstore{
+		{"k": stringPtr("a\x00b")},
+		{"a\x00b": stringPtr("v")},
+		{"k": stringPtr("\x00")},
+	}
+
+	// the codecs must preserve the null byte
+	for i, h := range nullByteHstores {
+		encoded := encodeHstoreBinary(t, h)
+		var decoded pgtype.Hstore
+		err := pgtype.HstoreCodec{}.PlanScan(nil, 0, pgtype.BinaryFormatCode, &decoded).Scan(encoded, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, h) {
+			t.Errorf("%d: binary codec round trip returned %#v; expected %#v", i, decoded, h)
+		}
+	}
+
+	cfg := newHstoreConfig(t)
+	ctx := context.Background()
+	conns := []struct {
+		label string
+		conn  *pgx.Conn
+	}{
+		{"text", connect(t, cfg)},
+		{"binary", connectRegistered(t, cfg)},
+	}
+	for _, c := range conns {
+		for i, h := range nullByteHstores {
+			// Postgres text values cannot contain the null byte: it must either return an error, or
+			// return the same value without truncating it
+			var out pgtype.Hstore
+			err := c.conn.QueryRow(ctx, "SELECT $1::hstore", h).Scan(&out)
+			if err != nil {
+				var pgErr *pgconn.PgError
+				if !errors.As(err, &pgErr) {
+					t.Errorf("%s %d: expected a Postgres error; got err=%#v", c.label, i, err)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(out, h) {
+				t.Errorf("%s %d: Postgres returned %#v; expected %#v", c.label, i, out, h)
+			}
+		}
+	}
+}
+
+// postgresBinDirGlob matches the directories of all installed Postgres versions on Debian/Ubuntu.
+const postgresBinDirGlob = "/usr/lib/postgresql/*/bin"
+
+// newVersionedHstoreConfig starts a Postgres instance using the binaries in binDir, and creates the
+// hstore extension. postgrestest finds the binaries with pg_config, so this puts a pg_config
+// script on PATH that prints binDir. Tests that call this cannot run in parallel.
+func newVersionedHstoreConfig(t *testing.T, binDir string) *pgx.ConnConfig {
+	scriptDir := t.TempDir()
+	script := "#!/bin/sh\necho '" + binDir + "'\n"
+	err := os.WriteFile(filepath.Join(scriptDir, "pg_config"), []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", scriptDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return newHstoreConfig(t)
+}
+
+func TestHstoreBinaryFormatAcrossPostgresVersions(t *testing.T) {
+	skipWithoutPostgres(t)
+	binDirs, err := filepath.Glob(postgresBinDirGlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versionDirs []string
+	for _, binDir := range binDirs {
+		if _, err := os.Stat(filepath.Join(binDir, "initdb")); err == nil {
+			versionDirs = append(versionDirs, binDir)
+		}
+	}
+	if len(versionDirs) < 2 {
+		t.Skipf("requires at least 2 Postgres versions in %s; found %#v", postgresBinDirGlob, versionDirs)
+	}
+
+	inputs := []string{
+		`"key"=>"value"`,
+		`a=>1, b=>NULL, c=>"", ""=>x`,
+		`"quote\""=>"back\\slash", "unicode"=>"a😅b"`,
+		``,
+	}
+	var firstEncoded [][]byte
+	for _, binDir := range versionDirs {
+		cfg := newVersionedHstoreConfig(t, binDir)
+		conn := connect(t, cfg)
+		var version string
+		err = conn.QueryRow(context.Background(), "SHOW server_version").Scan(&version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("testing Postgres version %s from %s", version, binDir)
+
+		for i, input := range inputs {
+			var encoded []byte
+			err = conn.QueryRow(context.Background(), "SELECT hstore_send($1::hstore)", input).Scan(&encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(firstEncoded) <= i {
+				firstEncoded = append(firstEncoded, encoded)
+			} else if !bytes.Equal(encoded, firstEncoded[i]) {
+				t.Errorf("version %s: hstore_send(%#v)=%#v; first version returned %#v",
+					version, input, encoded, firstEncoded[i])
+			}
+		}
+	}
+}
+
+// TestHstoreScanFromNotification checks that hstores sent as NOTIFY payloads, which are always
+// text, can be decoded with pgtype.Hstore.Scan.
+func TestHstoreScanFromNotification(t *testing.T) {
+	const channel = "hstore_notify"
+
+	cfg := newHstoreConfig(t)
+	listener := connect(t, cfg)
+	sender := connectRegistered(t, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := listener.Exec(ctx, "LISTEN "+channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := make(chan string)
+	listenErr := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(payloads)
+		for range roundTripHstores {
+			notification, err := listener.WaitForNotification(ctx)
+			if err != nil {
+				listenErr <- err
+				return
+			}
+			select {
+			case payloads <- notification.Payload:
+			case <-ctx.Done():
+				listenErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+	defer func() {
+		// stop the goroutine if the test fails, and wait so it does not use listener after it is closed
+		cancel()
+		<-done
+	}()
+
+	for _, h := range roundTripHstores {
+		_, err = sender.Exec(ctx, "SELECT pg_notify($1, $2::hstore::text)", channel, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// notifications from a single session are delivered in the order they were sent
+	i := 0
+	for payload := range payloads {
+		var h pgtype.Hstore
+		err = h.Scan(payload)
+		if err != nil {
+			t.Errorf("%d: Scan(%#v) err=%s", i, payload, err)
+		} else if !reflect.DeepEqual(h, roundTripHstores[i]) {
+			t.Errorf("%d: Scan(%#v)=%#v; expected %#v", i, payload, h, roundTripHstores[i])
+		}
+		i++
+	}
+	select {
+	case err = <-listenErr:
+		t.Fatal(err)
+	default:
+	}
+	if i != len(roundTripHstores) {
+		t.Errorf("received %d notifications; expected %d", i, len(roundTripHstores))
+	}
+}
+
+type requestIDKey struct{}
+
+// contextRecordingTracer records the request ID from the context that pgx passes to the tracer.
+type contextRecordingTracer struct {
+	requestID any
+}
+
+func (t *contextRecordingTracer) TraceQueryStart(
+	ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData,
+) context.Context {
+	t.requestID = ctx.Value(requestIDKey{})
+	return ctx
+}
+
+func (t *contextRecordingTracer) TraceQueryEnd(
+	ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData,
+) {
+}
+
+// TestHstoreScanContextPropagation checks that the query's context reaches a pgx.QueryTracer. pgx
+// v5 does not pass the context to Scan or ScanHstore methods, so code that needs context values
+// while scanning must get them from the tracer, not from the scanner.
+func TestHstoreScanContextPropagation(t *testing.T) {
+	const requestID = "request-123"
+
+	cfg := newHstoreConfig(t)
+	tracer := &contextRecordingTracer{}
+	cfg.Tracer = tracer
+	conn := connectRegistered(t, cfg)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, requestID)
+
+	var h pgtype.Hstore
+	err := conn.QueryRow(ctx, "SELECT 'k=>v'::hstore").Scan(&h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := pgtype.Hstore{"k": stringPtr("v")}
+	if !reflect.DeepEqual(h, expected) {
+		t.Errorf("scanned %#v; expected %#v", h, expected)
+	}
+	if tracer.requestID != requestID {
+		t.Errorf("tracer requestID=%#v; expected %#v", tracer.requestID, requestID)
+	}
+}
+
+// TestHstoreNullValueAllQueryModes checks that NULL values are preserved as nil pointers when
+// sent as a parameter and scanned with every query mode, and are not converted to empty strings
+// or omitted.
+func TestHstoreNullValueAllQueryModes(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	ctx := context.Background()
+
+	h := pgtype.Hstore{"null": nil, "empty": stringPtr(""), "k": stringPtr("v")}
+	for _, mode := range allQueryExecModes {
+		var out pgtype.Hstore
+		err := conn.QueryRow(ctx, "SELECT $1::hstore", mode, h).Scan(&out)
+		if err != nil {
+			t.Fatalf("%s: err=%s", mode, err)
+		}
+		if !reflect.DeepEqual(out, h) {
+			t.Errorf("%s: round trip=%#v; expected %#v", mode, out, h)
+		}
+
+		// Postgres must also see a NULL value
+		var isNull bool
+		err = conn.QueryRow(ctx, "SELECT $1::hstore -> 'null' IS NULL", mode, h).Scan(&isNull)
+		if err != nil {
+			t.Fatalf("%s: err=%s", mode, err)
+		}
+		if !isNull {
+			t.Errorf("%s: Postgres value for key \"null\" is not NULL", mode)
+		}
+	}
+}
+
+// TestHstoreWithPGExtensionUpgrade installs the oldest available hstore extension version, then
+// checks that ALTER EXTENSION hstore UPDATE does not change the OID or the results of scans.
+func TestHstoreWithPGExtensionUpgrade(t *testing.T) {
+	skipWithoutPostgres(t)
+	cfg, err := pgx.ParseConfig(postgrestest.New(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	textConn := connect(t, cfg)
+	ctx := context.Background()
+
+	var oldestVersion, defaultVersion string
+	err = textConn.QueryRow(ctx, `SELECT version FROM pg_available_extension_versions
+		WHERE name = 'hstore' ORDER BY string_to_array(version, '.')::int[] LIMIT 1`).Scan(&oldestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = textConn.QueryRow(ctx, "SELECT default_version FROM pg_available_extensions WHERE name = 'hstore'").Scan(&defaultVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldestVersion == defaultVersion {
+		t.Skipf("only hstore version %s is available: nothing to update", defaultVersion)
+	}
+
+	_, err = textConn.Exec(ctx, "CREATE EXTENSION hstore VERSION '"+oldestVersion+"'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	createBenchmarkTable(t, textConn)
+	expected := queryBenchmarkByID(t, textConn)
+	oidBefore, err := queryHstoreOID(ctx, textConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredBefore := connectRegistered(t, cfg)
+	if hstores := queryBenchmarkByID(t, registeredBefore); !reflect.DeepEqual(hstores, expected) {
+		t.Fatalf("hstore version %s: binary results differ from the text format", oldestVersion)
+	}
+
+	_, err = textConn.Exec(ctx, "ALTER EXTENSION hstore UPDATE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var installedVersion string
+	err = textConn.QueryRow(ctx, "SELECT extversion FROM pg_extension WHERE extname = 'hstore'").Scan(&installedVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if installedVersion != defaultVersion {
+		t.Fatalf("hstore version after update=%s; expected %s", installedVersion, defaultVersion)
+	}
+	t.Logf("updated hstore from version %s to %s", oldestVersion, installedVersion)
+
+	oidAfter, err := queryHstoreOID(ctx, textConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oidAfter != oidBefore {
+		t.Errorf("hstore OID changed from %d to %d", oidBefore, oidAfter)
+	}
+	conns := []struct {
+		label string
+		conn  *pgx.Conn
+	}{
+		{"text", textConn},
+		{"registered_before_update", registeredBefore},
+		{"registered_after_update", connectRegistered(t, cfg)},
+	}
+	for _, c := range conns {
+		if hstores := queryBenchmarkByID(t, c.conn); !reflect.DeepEqual(hstores, expected) {
+			t.Errorf("%s: results after update differ from before the update", c.label)
+		}
+	}
+}
+
+// newLogicalReplicationHstoreConfig starts a Postgres instance with wal_level=logical, and creates
+// the hstore extension. postgrestest has no way to pass server options, so this creates a
+// directory with links to the Postgres binaries, where postgres is a script that adds the option.
+// Tests that call this cannot run in parallel.
+func newLogicalReplicationHstoreConfig(t *testing.T) *pgx.ConnConfig {
+	skipWithoutPostgres(t)
+	out, err := exec.Command("pg_config", "--bindir").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realBinDir := strings.TrimSpace(string(out))
+	entries, err := os.ReadDir(realBinDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binDir := t.TempDir()
+	for _, entry := range entries {
+		if entry.Name() == "postgres" {
+			continue
+		}
+		err = os.Symlink(filepath.Join(realBinDir, entry.Name()), filepath.Join(binDir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// initdb also runs postgres, but finds it next to the real initdb; only change the server
+	realPostgres := filepath.Join(realBinDir, "postgres")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = \"-D\" ]; then exec '" + realPostgres + "' \"$@\" -c wal_level=logical; fi\n" +
+		"exec '" + realPostgres + "' \"$@\"\n"
+	err = os.WriteFile(filepath.Join(binDir, "postgres"), []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newVersionedHstoreConfig(t, binDir)
+}
+
+// pgoutputInsertValues returns the text column values from a pgoutput Insert message. NULL values
+// are nil. See https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+func pgoutputInsertValues(message []byte) ([][]byte, error) {
+	// 'I', relation OID, 'N' for a new tuple
+	const insertHeaderLen = 1 + uint32Len + 1
+	if len(message) < insertHeaderLen+2 || message[0] != 'I' || message[insertHeaderLen-1] != 'N' {
+		return nil, fmt.Errorf("pgoutput: not an insert message: %#v", message)
+	}
+	rp := insertHeaderLen
+	numColumns := int(binary.BigEndian.Uint16(message[rp:]))
+	rp += 2
+
+	values := make([][]byte, numColumns)
+	for i := range values {
+		if len(message[rp:]) < 1 {
+			return nil, fmt.Errorf("pgoutput: insert message truncated at column %d", i)
+		}
+		kind := message[rp]
+		rp++
+		switch kind {
+		case 'n':
+			values[i] = nil
+		case 't':
+			if len(message[rp:]) < uint32Len {
+				return nil, fmt.Errorf("pgoutput: insert message truncated at column %d", i)
+			}
+			valueLen := int(binary.BigEndian.Uint32(message[rp:]))
+			rp += uint32Len
+			if len(message[rp:]) < valueLen {
+				return nil, fmt.Errorf("pgoutput: insert message truncated at column %d", i)
+			}
+			values[i] = message[rp : rp+valueLen]
+			rp += valueLen
+		default:
+			return nil, fmt.Errorf("pgoutput: column %d has unsupported kind %q", i, kind)
+		}
+	}
+	return values, nil
+}
+
+// TestHstoreScanFromLogicalReplication checks that hstores in inserts decoded by the pgoutput
+// logical replication plugin, which sends values as text, can be decoded with pgtype.Hstore.Scan.
+// It reads the changes with pg_logical_slot_get_binary_changes, which returns the same messages
+// as a replication connection.
+func TestHstoreScanFromLogicalReplication(t *testing.T) {
+	cfg := newLogicalReplicationHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	createBenchmarkTable(t, conn)
+	ctx := context.Background()
+
+	_, err := conn.Exec(ctx, "CREATE PUBLICATION hstore_pub FOR TABLE benchmark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, "SELECT pg_create_logical_replication_slot('hstore_slot', 'pgoutput')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range roundTripHstores {
+		_, err = conn.Exec(ctx, "INSERT INTO benchmark (kv) VALUES ($1)", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := conn.Query(ctx, `SELECT data FROM pg_logical_slot_get_binary_changes(
+		'hstore_slot', NULL, NULL, 'proto_version', '1', 'publication_names', 'hstore_pub')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inserted []pgtype.Hstore
+	for rows.Next() {
+		var message []byte
+		err = rows.Scan(&message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(message) == 0 || message[0] != 'I' {
+			continue
+		}
+		values, err := pgoutputInsertValues(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// columns: id, kv
+		if len(values) != 2 {
+			t.Fatalf("expected 2 columns; found %d in %#v", len(values), message)
+		}
+		var h pgtype.Hstore
+		err = h.Scan(string(values[1]))
+		if err != nil {
+			t.Fatalf("Scan(%#v) err=%s", string(values[1]), err)
+		}
+		inserted = append(inserted, h)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	if !reflect.DeepEqual(inserted, roundTripHstores) {
+		t.Errorf("replicated hstores=%#v; expected %#v", inserted, roundTripHstores)
+	}
+}
+
+func TestPGOutputInsertValues(t *testing.T) {
+	message := []byte{'I', 0, 0, 0x40, 0, 'N', 0, 3,
+		't', 0, 0, 0, 1, '1',
+		'n',
+		't', 0, 0, 0, 8, '"', 'k', '"', '=', '>', '"', 'v', '"'}
+	values, err := pgoutputInsertValues(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]byte{[]byte("1"), nil, []byte(`"k"=>"v"`)}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("pgoutputInsertValues=%#v; expected %#v", values, expected)
+	}
+
+	for _, truncated := range [][]byte{message[:4], message[:10], message[:len(message)-1]} {
+		values, err = pgoutputInsertValues(truncated)
+		if err == nil {
+			t.Errorf("pgoutputInsertValues(%#v)=%#v; expected error", truncated, values)
+		}
+	}
+}
+
+// TestHstoreScanWithTraceLog checks that a tracelog.TraceLog that logs every query and its
+// arguments does not change the hstores that are sent or scanned.
+func TestHstoreScanWithTraceLog(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	textConn := connect(t, cfg)
+	createBenchmarkTable(t, textConn)
+	expected := queryBenchmarkByID(t, textConn)
+	ctx := context.Background()
+
+	var logs []string
+	tracedCfg := cfg.Copy()
+	tracedCfg.Tracer = &tracelog.TraceLog{
+		Logger: tracelog.LoggerFunc(func(ctx context.Context, level tracelog.LogLevel, msg string, data map[string]any) {
+			logs = append(logs, fmt.Sprintf("%s %s %v", level, msg, data))
+		}),
+		LogLevel: tracelog.LogLevelTrace,
+	}
+	conn := connectRegistered(t, tracedCfg)
+
+	if hstores := queryBenchmarkByID(t, conn); !reflect.DeepEqual(hstores, expected) {
+		t.Error("traced connection returned different hstores than the text format")
+	}
+	for i, h := range roundTripHstores {
+		var out pgtype.Hstore
+		err := conn.QueryRow(ctx, "SELECT $1::hstore", h).Scan(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, h) {
+			t.Errorf("%d: traced round trip=%#v; expected %#v", i, out, h)
+		}
+	}
+
+	// the tracer must have logged the queries with their arguments
+	loggedArgs := false
+	for _, log := range logs {
+		if strings.Contains(log, "SELECT $1::hstore") && strings.Contains(log, "args:") {
+			loggedArgs = true
+			break
+		}
+	}
+	if !loggedArgs {
+		t.Errorf("tracer did not log the query arguments; logs=%#v", logs)
+	}
+}
+
+// TestHstoreEmptySearchPath checks that queryHstoreOID finds hstore when search_path does not
+// include the schema where the extension is installed, since pg_catalog is always searched, and
+// that rows.Values returns pgtype.Hstore on that connection.
+func TestHstoreEmptySearchPath(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	defaultConn := connect(t, cfg)
+	createBenchmarkTable(t, defaultConn)
+	expected := queryBenchmarkByID(t, defaultConn)
+	ctx := context.Background()
+	expectedOID, err := queryHstoreOID(ctx, defaultConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emptyPathCfg := cfg.Copy()
+	emptyPathCfg.RuntimeParams["search_path"] = ""
+	conn := connect(t, emptyPathCfg)
+
+	// hstore is in public, which is no longer searched
+	_, err = conn.Exec(ctx, "SELECT 'k=>v'::hstore")
+	if err == nil {
+		t.Fatal("hstore type must not be found with an empty search_path")
+	}
+
+	hstoreOID, err := queryHstoreOID(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hstoreOID != expectedOID {
+		t.Errorf("queryHstoreOID=%d with an empty search_path; expected %d", hstoreOID, expectedOID)
+	}
+	registerHstoreTypeMap(hstoreOID, conn.TypeMap(), pgtype.HstoreCodec{})
+
+	rows, err := conn.Query(ctx, "SELECT id, kv FROM public.benchmark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanned := 0
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := int(values[0].(int32))
+		h, ok := values[1].(pgtype.Hstore)
+		if !ok {
+			t.Fatalf("id=%d: rows.Values returned %T; expected pgtype.Hstore", id, values[1])
+		}
+		if !reflect.DeepEqual(h, expected[id]) {
+			t.Errorf("id=%d: rows.Values returned %#v; expected %#v", id, h, expected[id])
+		}
+		scanned++
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	if scanned != len(expected) {
+		t.Errorf("scanned %d rows; expected %d", scanned, len(expected))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/evanj/hacks/postgrestest"
+	"github.com/jackc/pgx/v5"
+)
+
+var tlsMode = flag.String("tls", "",
+	"set to client_cert to run BenchmarkHstoreTLS; it reconfigures a Postgres listening on localhost:5432")
+
+const tlsModeClientCert = "client_cert"
+
+// certFiles are the paths to PEM files for a certificate and its private key.
+type certFiles struct {
+	cert string
+	key  string
+}
+
+// writeCert creates a certificate signed by parent and writes it to dir. If parent is nil, the
+// certificate is a self-signed CA.
+func writeCert(tb testing.TB, dir string, name string, template *x509.Certificate,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey, certFiles) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	files := certFiles{filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")}
+	// Postgres and libpq require private keys to only be readable by the owner
+	err = os.WriteFile(files.cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = os.WriteFile(files.key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return cert, key, files
+}
+
+// configureClientCertTLS enables TLS on the Postgres server connected to conn, and requires
+// connections from localhost to use a client certificate. It returns a config for a localhost TLS
+// connection that uses a client certificate for user.
+func configureClientCertTLS(tb testing.TB, conn *pgx.Conn, localhostURL string, user string) *pgx.ConnConfig {
+	ctx := context.Background()
+	dir := tb.TempDir()
+
+	ca, caKey, caFiles := writeCert(tb, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "hstorebench test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverFiles := writeCert(tb, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	// the cert authentication method requires the common name to be the user
+	_, _, clientFiles := writeCert(tb, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: user},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	// require client certificates for TCP connections from localhost: pg_hba.conf uses the first
+	// matching line, so put it at the start of the file
+	var hbaFile string
+	err := conn.QueryRow(ctx, "SHOW hba_file").Scan(&hbaFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hba, err := os.ReadFile(hbaFile)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hba = append([]byte("hostssl all all 127.0.0.1/32 cert\n"), hba...)
+	err = os.WriteFile(hbaFile, hba, 0600)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for _, statement := range []string{
+		"ALTER SYSTEM SET ssl_cert_file = '" + serverFiles.cert + "'",
+		"ALTER SYSTEM SET ssl_key_file = '" + serverFiles.key + "'",
+		"ALTER SYSTEM SET ssl_ca_file = '" + caFiles.cert + "'",
+		"ALTER SYSTEM SET ssl = on",
+		"SELECT pg_reload_conf()",
+	} {
+		_, err = conn.Exec(ctx, statement)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	cfg, err := pgx.ParseConfig(localhostURL + "?sslmode=verify-full" +
+		"&sslrootcert=" + caFiles.cert + "&sslcert=" + clientFiles.cert + "&sslkey=" + clientFiles.key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg.User = user
+	return cfg
+}
+
+func BenchmarkHstoreTLS(b *testing.B) {
+	if *tlsMode != tlsModeClientCert {
+		b.Skipf("requires -tls=%s", tlsModeClientCert)
+	}
+	skipWithoutPostgres(b)
+
+	instance, err := postgrestest.NewInstanceWithOptions(postgrestest.Options{ListenOnLocalhost: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { instance.Close() })
+	cfg, err := pgx.ParseConfig(instance.URL())
+	if err != nil {
+		b.Fatal(err)
+	}
+	conn := connect(b, cfg)
+	_, err = conn.Exec(context.Background(), "CREATE EXTENSION hstore")
+	if err != nil {
+		b.Fatal(err)
+	}
+	createBenchmarkTable(b, conn)
+
+	tlsConfig := configureClientCertTLS(b, conn, instance.LocalhostURL(), cfg.User)
+	ctx := context.Background()
+
+	// measures the sustained cost of TLS: connections are created before the benchmark runs, so
+	// the handshake is not included
+	conns := []struct {
+		label string
+		conn  *pgx.Conn
+	}{
+		{"no_tls", connectRegistered(b, cfg)},
+		{"tls_client_cert", connectRegistered(b, tlsConfig)},
+	}
+	if _, ok := conns[1].conn.PgConn().Conn().(*tls.Conn); !ok {
+		b.Fatalf("expected a TLS connection; got %T", conns[1].conn.PgConn().Conn())
+	}
+	for _, c := range conns {
+		b.Run(c.label, timeIt(func() error {
+			_, err := scanHstores(ctx, c.conn, "SELECT kv FROM benchmark")
+			return err
+		}))
+	}
+}
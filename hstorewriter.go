@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// HstoreWriter buffers hstores and inserts them in batches with COPY FROM. Conn must have the
+// hstore type registered, since COPY uses the binary format. Callers must call Flush after the
+// last Write.
+type HstoreWriter struct {
+	Conn      *pgx.Conn
+	Table     string
+	Column    string
+	BatchSize int
+
+	rows [][]any
+}
+
+// Write buffers h, and flushes the buffered rows if there are BatchSize rows.
+func (w *HstoreWriter) Write(ctx context.Context, h pgtype.Hstore) error {
+	w.rows = append(w.rows, []any{h})
+	if len(w.rows) >= w.BatchSize {
+		return w.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush inserts all buffered rows. If it returns an error, the rows are discarded.
+func (w *HstoreWriter) Flush(ctx context.Context) error {
+	if len(w.rows) == 0 {
+		return nil
+	}
+	rows := w.rows
+	w.rows = w.rows[:0]
+	_, err := w.Conn.CopyFrom(ctx, pgx.Identifier{w.Table}, []string{w.Column}, pgx.CopyFromRows(rows))
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	mathrand "math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestHstoreWriter(t *testing.T) {
+	cfg := newHstoreConfig(t)
+	conn := connectRegistered(t, cfg)
+	ctx := context.Background()
+	_, err := conn.Exec(ctx, "CREATE TABLE written (id SERIAL PRIMARY KEY, kv HSTORE)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countRows := func() int {
+		t.Helper()
+		var count int
+		err := conn.QueryRow(ctx, "SELECT count(*) FROM written").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	writer := &HstoreWriter{Conn: conn, Table: "written", Column: "kv", BatchSize: 3}
+	expected := append(roundTripHstores, nil)
+	for i, h := range expected {
+		err = writer.Write(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// rows are only written in complete batches
+		expectedCount := (i + 1) / writer.BatchSize * writer.BatchSize
+		if count := countRows(); count != expectedCount {
+			t.Errorf("after %d writes: expected %d rows; found %d", i+1, expectedCount, count)
+		}
+	}
+	err = writer.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT kv FROM written ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []pgtype.Hstore
+	for rows.Next() {
+		var h pgtype.Hstore
+		err = rows.Scan(&h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, h)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("wrote %#v; read %#v", expected, written)
+	}
+}
+
+func BenchmarkHstoreWriter(b *testing.B) {
+	const rowsPerOp = 1000
+
+	cfg := newHstoreConfig(b)
+	conn := connectRegistered(b, cfg)
+	ctx := context.Background()
+	_, err := conn.Exec(ctx, "CREATE TABLE written (kv HSTORE)")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rng := mathrand.New(mathrand.NewSource(rngSeed))
+	hstores := make([]pgtype.Hstore, rowsPerOp)
+	for i := range hstores {
+		hstores[i] = genHstore(rng, 1+rng.Intn(maxKVPairsPerRow-1))
+	}
+
+	b.Run("insert", timeIt(func() error {
+		for _, h := range hstores {
+			_, err := conn.Exec(ctx, "INSERT INTO written VALUES ($1)", h)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	for _, batchSize := range []int{100, rowsPerOp} {
+		writer := &HstoreWriter{Conn: conn, Table: "written", Column: "kv", BatchSize: batchSize}
+		b.Run(fmt.Sprintf("HstoreWriter/batch_size=%d", batchSize), timeIt(func() error {
+			for _, h := range hstores {
+				err := writer.Write(ctx, h)
+				if err != nil {
+					return err
+				}
+			}
+			return writer.Flush(ctx)
+		}))
+	}
+}